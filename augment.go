@@ -0,0 +1,299 @@
+package mnistdemo
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+)
+
+// An Augmenter randomly perturbs samples, giving
+// learners more varied training data.
+type Augmenter interface {
+	Augment(s *Sample, gen *rand.Rand) *Sample
+}
+
+// An AugmenterDesc includes a plain-text description
+// of an augmenter as well as a constructor for it
+// with its default settings.
+type AugmenterDesc struct {
+	Desc      string
+	Construct func() Augmenter
+}
+
+// Augmenters stores AugmenterDescs for each
+// available augmenter.
+var Augmenters = map[string]AugmenterDesc{
+	"affine": AugmenterDesc{
+		Desc: "random shift, rotation, scale and shear",
+		Construct: func() Augmenter {
+			return &Affine{Shift: 2, Rotation: 0.25, Scale: 0.15, Shear: 0.2}
+		},
+	},
+	"elastic": AugmenterDesc{
+		Desc: "smoothed random displacements",
+		Construct: func() Augmenter {
+			return &Elastic{Alpha: 34, Sigma: 4}
+		},
+	},
+	"morph": AugmenterDesc{
+		Desc: "stroke thickening or thinning",
+		Construct: func() Augmenter {
+			return &Morphology{Probability: 0.5}
+		},
+	},
+	"noise": AugmenterDesc{
+		Desc: "gaussian pixel noise",
+		Construct: func() Augmenter {
+			return &Noise{Stddev: 0.05}
+		},
+	},
+	"cutout": AugmenterDesc{
+		Desc: "erase a random square",
+		Construct: func() Augmenter {
+			return &Cutout{Size: 8}
+		},
+	},
+}
+
+// ParseAugmenter creates an AugmentChain from a
+// comma-separated list of names in Augmenters.
+func ParseAugmenter(spec string) (AugmentChain, error) {
+	var res AugmentChain
+	for _, name := range strings.Split(spec, ",") {
+		desc, ok := Augmenters[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown augmenter: %s", name)
+		}
+		res = append(res, desc.Construct())
+	}
+	return res, nil
+}
+
+// AugmentSamples returns the samples followed by
+// copies augmented versions of each one.
+func AugmentSamples(data []*TrainingSample, aug Augmenter, copies int,
+	gen *rand.Rand) []*TrainingSample {
+	res := append([]*TrainingSample{}, data...)
+	for i := 0; i < copies; i++ {
+		for _, x := range data {
+			res = append(res, &TrainingSample{
+				Sample: aug.Augment(x.Sample, gen),
+				Label:  x.Label,
+			})
+		}
+	}
+	return res
+}
+
+// An AugmentChain applies augmenters in order.
+type AugmentChain []Augmenter
+
+func (a AugmentChain) Augment(s *Sample, gen *rand.Rand) *Sample {
+	for _, aug := range a {
+		s = aug.Augment(s, gen)
+	}
+	return s
+}
+
+// Affine applies a random affine transformation about
+// the center of the image.
+//
+// Each field is the largest magnitude of its
+// parameter, which is drawn uniformly: Shift in
+// pixels, Rotation in radians, Scale as a fraction of
+// the original size, and Shear as a slope.
+type Affine struct {
+	Shift    float64
+	Rotation float64
+	Scale    float64
+	Shear    float64
+}
+
+func (a *Affine) Augment(s *Sample, gen *rand.Rand) *Sample {
+	uniform := func(max float64) float64 {
+		return max * (gen.Float64()*2 - 1)
+	}
+	dx, dy := uniform(a.Shift), uniform(a.Shift)
+	angle := uniform(a.Rotation)
+	scale := 1 + uniform(a.Scale)
+	shear := uniform(a.Shear)
+
+	// Forward transform: rotation * shear * scale.
+	cos, sin := math.Cos(angle), math.Sin(angle)
+	m00, m01 := cos*scale, (cos*shear-sin)*scale
+	m10, m11 := sin*scale, (sin*shear+cos)*scale
+	det := m00*m11 - m01*m10
+
+	const center = 13.5
+	res := new(Sample)
+	for y := 0; y < 28; y++ {
+		for x := 0; x < 28; x++ {
+			px := float64(x) - center - dx
+			py := float64(y) - center - dy
+			srcX := (m11*px-m01*py)/det + center
+			srcY := (-m10*px+m00*py)/det + center
+			res[y*28+x] = s.bilinear(srcX, srcY)
+		}
+	}
+	return res
+}
+
+// Elastic applies an elastic distortion, moving each
+// pixel by a random displacement field which is
+// smoothed with a Gaussian of standard deviation
+// Sigma and scaled by Alpha.
+type Elastic struct {
+	Alpha float64
+	Sigma float64
+}
+
+func (e *Elastic) Augment(s *Sample, gen *rand.Rand) *Sample {
+	fieldX := make([]float64, 28*28)
+	fieldY := make([]float64, 28*28)
+	for i := range fieldX {
+		fieldX[i] = gen.Float64()*2 - 1
+		fieldY[i] = gen.Float64()*2 - 1
+	}
+	gaussianBlur(fieldX, e.Sigma)
+	gaussianBlur(fieldY, e.Sigma)
+
+	res := new(Sample)
+	for y := 0; y < 28; y++ {
+		for x := 0; x < 28; x++ {
+			i := y*28 + x
+			res[i] = s.bilinear(float64(x)+e.Alpha*fieldX[i],
+				float64(y)+e.Alpha*fieldY[i])
+		}
+	}
+	return res
+}
+
+// Morphology thickens or thins strokes by one pixel,
+// taking the maximum or minimum over each pixel's
+// neighbors.
+// It changes a sample with the given Probability,
+// and thickening and thinning are equally likely.
+type Morphology struct {
+	Probability float64
+}
+
+func (m *Morphology) Augment(s *Sample, gen *rand.Rand) *Sample {
+	if gen.Float64() >= m.Probability {
+		return s
+	}
+	dilate := gen.Intn(2) == 0
+	res := new(Sample)
+	for y := 0; y < 28; y++ {
+		for x := 0; x < 28; x++ {
+			value := s[y*28+x]
+			for _, d := range [][2]int{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+				nx, ny := x+d[0], y+d[1]
+				var neighbor float64
+				if nx >= 0 && nx < 28 && ny >= 0 && ny < 28 {
+					neighbor = s[ny*28+nx]
+				}
+				if dilate {
+					value = math.Max(value, neighbor)
+				} else {
+					value = math.Min(value, neighbor)
+				}
+			}
+			res[y*28+x] = value
+		}
+	}
+	return res
+}
+
+// Noise adds Gaussian noise to every pixel.
+type Noise struct {
+	Stddev float64
+}
+
+func (n *Noise) Augment(s *Sample, gen *rand.Rand) *Sample {
+	res := new(Sample)
+	for i, x := range s {
+		res[i] = x + gen.NormFloat64()*n.Stddev
+	}
+	res.clip()
+	return res
+}
+
+// Cutout erases a Size by Size square centered on a
+// random pixel.
+type Cutout struct {
+	Size int
+}
+
+func (c *Cutout) Augment(s *Sample, gen *rand.Rand) *Sample {
+	res := *s
+	startX := gen.Intn(28) - c.Size/2
+	startY := gen.Intn(28) - c.Size/2
+	for y := maxInt(startY, 0); y < minInt(startY+c.Size, 28); y++ {
+		for x := maxInt(startX, 0); x < minInt(startX+c.Size, 28); x++ {
+			res[y*28+x] = 0
+		}
+	}
+	return &res
+}
+
+// bilinear interpolates the image at a point,
+// treating pixels outside the image as white.
+func (s *Sample) bilinear(x, y float64) float64 {
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := x-x0, y-y0
+	pixel := func(x, y int) float64 {
+		if x < 0 || x >= 28 || y < 0 || y >= 28 {
+			return 0
+		}
+		return s[y*28+x]
+	}
+	ix, iy := int(x0), int(y0)
+	return (1-fy)*((1-fx)*pixel(ix, iy)+fx*pixel(ix+1, iy)) +
+		fy*((1-fx)*pixel(ix, iy+1)+fx*pixel(ix+1, iy+1))
+}
+
+// gaussianBlur blurs a 28x28 field in place with a
+// separable Gaussian kernel, clamping at the edges.
+func gaussianBlur(field []float64, sigma float64) {
+	radius := int(math.Ceil(3 * sigma))
+	kernel := make([]float64, 2*radius+1)
+	var sum float64
+	for i := range kernel {
+		d := float64(i - radius)
+		kernel[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+	temp := make([]float64, len(field))
+	for _, horizontal := range []bool{true, false} {
+		for y := 0; y < 28; y++ {
+			for x := 0; x < 28; x++ {
+				var value float64
+				for i, k := range kernel {
+					nx, ny := x, y
+					if horizontal {
+						nx = clampInt(x+i-radius, 0, 27)
+					} else {
+						ny = clampInt(y+i-radius, 0, 27)
+					}
+					value += k * field[ny*28+nx]
+				}
+				temp[y*28+x] = value
+			}
+		}
+		copy(field, temp)
+	}
+}
+
+func clampInt(x, min, max int) int {
+	if x < min {
+		return min
+	}
+	if x > max {
+		return max
+	}
+	return x
+}
@@ -2,21 +2,22 @@ package mnistdemo
 
 import (
 	"encoding/json"
+	"image"
 	"log"
 	"math"
 	"math/rand"
+	"sync"
 
-	"github.com/unixpickle/approb"
 	"github.com/unixpickle/num-analysis/linalg"
-	"github.com/unixpickle/num-analysis/linalg/qrdecomp"
 	"github.com/unixpickle/serializer"
 )
 
 const bayesSerializerID = "github.com/unixpickle/mnistdemo.Bayes"
 
 const (
-	bayesFeatures      = 50
-	bayesEigIterations = 300
+	bayesFeatures          = 50
+	bayesCovarianceSamples = 5000
+	bayesVarianceFloor     = 1e-9
 )
 
 func init() {
@@ -28,10 +29,87 @@ type Gaussian struct {
 	Variance float64
 }
 
+// GaussianStats accumulates the count, mean, and sum
+// of squared deviations of a stream of values using
+// Welford's algorithm, which avoids the cancellation
+// of computing E[x^2] - E[x]^2.
+type GaussianStats struct {
+	Count float64
+	Mean  float64
+	M2    float64
+}
+
+// Add adds a value to the statistics.
+func (g *GaussianStats) Add(x float64) {
+	g.Count++
+	delta := x - g.Mean
+	g.Mean += delta / g.Count
+	g.M2 += delta * (x - g.Mean)
+}
+
+// Merge adds the values from another set of
+// statistics using Chan et al.'s parallel update.
+func (g *GaussianStats) Merge(g1 *GaussianStats) {
+	if g1.Count == 0 {
+		return
+	}
+	count := g.Count + g1.Count
+	delta := g1.Mean - g.Mean
+	g.M2 += g1.M2 + delta*delta*g.Count*g1.Count/count
+	g.Mean += delta * g1.Count / count
+	g.Count = count
+}
+
+// Gaussian returns the maximum-likelihood Gaussian
+// for the values, with a lower bound on variance.
+func (g *GaussianStats) Gaussian(varianceFloor float64) Gaussian {
+	var variance float64
+	if g.Count > 0 {
+		variance = g.M2 / g.Count
+	}
+	return Gaussian{
+		Mean:     g.Mean,
+		Variance: math.Max(variance, varianceFloor),
+	}
+}
+
+// BayesStats stores sufficient statistics for every
+// feature of every class.
+type BayesStats struct {
+	Classes [10][bayesFeatures]GaussianStats
+}
+
+// Merge adds the statistics from s1 to s.
+func (s *BayesStats) Merge(s1 *BayesStats) {
+	for i := range s.Classes {
+		for j := range s.Classes[i] {
+			s.Classes[i][j].Merge(&s1.Classes[i][j])
+		}
+	}
+}
+
+// Bayes is a Gaussian naive Bayes classifier on PCA
+// features.
+//
+// Stats keeps the sufficient statistics behind the
+// Gaussians so that the model can be updated with
+// new samples.
+// VarianceFloor bounds every variance from below,
+// defaulting to 1e-9.
+//
+// If Features is set, the principal components are
+// computed from its features rather than from
+// pixels, and the model cannot render or generate
+// images, so Generate, Prototype and RenderImages
+// panic.
 type Bayes struct {
 	Classes [10][bayesFeatures]Gaussian
 	Total   [bayesFeatures]Gaussian
 	Basis   *linalg.Matrix
+
+	Stats         *BayesStats       `json:",omitempty"`
+	VarianceFloor float64           `json:",omitempty"`
+	Features      *FeatureExtractor `json:",omitempty"`
 }
 
 func DeserializeBayes(d []byte) (*Bayes, error) {
@@ -50,14 +128,8 @@ func (b *Bayes) Train(data, validation []*TrainingSample) {
 	log.Println("Computing basis features...")
 	b.computeBasis(data)
 	log.Println("Training classifier...")
-	for i := 0; i < 10; i++ {
-		b.computeGaussians(&b.Classes[i], data, func(j int) bool {
-			return j == i
-		})
-	}
-	b.computeGaussians(&b.Total, data, func(j int) bool {
-		return true
-	})
+	b.Stats = &BayesStats{}
+	b.Update(data)
 	log.Println("Running cross validation...")
 	var correct, total int
 	for _, s := range validation {
@@ -70,9 +142,17 @@ func (b *Bayes) Train(data, validation []*TrainingSample) {
 }
 
 func (b *Bayes) Classify(s *Sample) int {
-	features := b.Basis.MulFast(linalg.NewMatrixColumn(s[:])).Data
-	bestLogProb := math.Inf(-1)
-	bestAnswer := 0
+	scores := b.Scores(s)
+	return maxIndex(scores[:])
+}
+
+// Scores computes each class's log-likelihood ratio
+// against the distribution of all the data (scaled
+// by two).
+func (b *Bayes) Scores(s *Sample) [10]float64 {
+	inputs := b.Features.Inputs(s)
+	features := b.Basis.MulFast(linalg.NewMatrixColumn(inputs)).Data
+	var res [10]float64
 	for i := 0; i < 10; i++ {
 		gaussians := &b.Classes[i]
 		var logProb float64
@@ -82,12 +162,40 @@ func (b *Bayes) Classify(s *Sample) int {
 			logProb += math.Pow(features[j]-g0.Mean, 2) / g0.Variance
 			logProb -= math.Pow(features[j]-g.Mean, 2) / g.Variance
 		}
-		if logProb > bestLogProb {
-			bestLogProb = logProb
-			bestAnswer = i
-		}
+		res[i] = logProb
 	}
-	return bestAnswer
+	return res
+}
+
+// Generate draws a synthetic image of a class by
+// sampling each feature from the class's Gaussian
+// and projecting back through the basis.
+func (b *Bayes) Generate(class int, gen *rand.Rand) *Sample {
+	var features [bayesFeatures]float64
+	for i, g := range b.Classes[class] {
+		features[i] = g.Mean + gen.NormFloat64()*math.Sqrt(g.Variance)
+	}
+	return b.reconstruct(features[:])
+}
+
+// Prototype renders a class's mean image, with every
+// feature shifted by k standard deviations.
+// A k of 0 yields the plain class mean.
+func (b *Bayes) Prototype(class int, k float64) *Sample {
+	var features [bayesFeatures]float64
+	for i, g := range b.Classes[class] {
+		features[i] = g.Mean + k*math.Sqrt(g.Variance)
+	}
+	return b.reconstruct(features[:])
+}
+
+// RenderImages renders the mean image of each class.
+func (b *Bayes) RenderImages() []image.Image {
+	var res []image.Image
+	for class := range b.Classes {
+		res = append(res, b.Prototype(class, 0).Image())
+	}
+	return res
 }
 
 func (b *Bayes) SerializerType() string {
@@ -103,58 +211,98 @@ func (b *Bayes) Serialize() ([]byte, error) {
 }
 
 func (b *Bayes) computeBasis(data []*TrainingSample) {
-	log.Println("Computing covariance matrix...")
-	cvm := computeCovarianceMatrix(data)
-	log.Println("Computing eigenvalues...")
-	vals, vecs := largestEigenvectors(cvm)
-	log.Println("Largest variance:", linalg.Vector(vals).MaxAbs())
-
-	basis := vecs[:bayesFeatures]
-	b.Basis = linalg.NewMatrix(bayesFeatures, 28*28)
-	for i, x := range basis {
-		copy(b.Basis.Data[i*28*28:(i+1)*28*28], x)
-	}
-}
-
-func (b *Bayes) computeGaussians(g *[bayesFeatures]Gaussian, set []*TrainingSample,
-	filter func(n int) bool) {
-	var total int
-	for _, x := range set {
-		if filter(x.Label) {
-			total++
-			features := b.Basis.MulFast(linalg.NewMatrixColumn(x.Sample[:]))
-			for i, v := range features.Data {
-				g[i].Mean += v
-				g[i].Variance += v * v
-			}
+	b.Basis = principalBasis(b.Features.inputVectors(data))
+}
+
+// reconstruct maps features back to pixel space.
+// Basis rows are orthogonal but, in older models,
+// not unit length, so each row is divided by its
+// squared norm.
+func (b *Bayes) reconstruct(features []float64) *Sample {
+	if b.Features != nil {
+		panic("cannot reconstruct images from extracted features")
+	}
+	res := new(Sample)
+	for i, f := range features {
+		row := b.Basis.Data[i*28*28 : (i+1)*28*28]
+		var normSquared float64
+		for _, x := range row {
+			normSquared += x * x
+		}
+		for j, x := range row {
+			res[j] += f * x / normSquared
 		}
 	}
-	for i := range g[:] {
-		g[i].Mean /= float64(total)
-		g[i].Variance = g[i].Variance/float64(total) - g[i].Mean*g[i].Mean
+	res.clip()
+	return res
+}
+
+// Update adds labeled samples to the model's
+// statistics and recomputes its Gaussians.
+// The basis is left unchanged.
+func (b *Bayes) Update(data []*TrainingSample) {
+	if b.Stats == nil {
+		panic("model has no statistics to update")
 	}
+	b.Stats.Merge(b.computeStats(data))
+	b.computeGaussians()
 }
 
-func computeCovarianceMatrix(data []*TrainingSample) *linalg.Matrix {
-	return approb.Covariances(5000, func() linalg.Vector {
-		return data[rand.Intn(len(data))].Sample[:]
+// computeStats gathers statistics in a single pass
+// over the data, splitting it between goroutines
+// and merging their results.
+func (b *Bayes) computeStats(data []*TrainingSample) *BayesStats {
+	res := &BayesStats{}
+	var lock sync.Mutex
+	parallelChunks(len(data), func(start, end int) {
+		local := &BayesStats{}
+		for _, x := range data[start:end] {
+			inputs := b.Features.Inputs(x.Sample)
+			features := b.Basis.MulFast(linalg.NewMatrixColumn(inputs))
+			for i, v := range features.Data {
+				local.Classes[x.Label][i].Add(v)
+			}
+		}
+		lock.Lock()
+		res.Merge(local)
+		lock.Unlock()
 	})
+	return res
 }
 
-func largestEigenvectors(mat *linalg.Matrix) (vals []float64, vecs []linalg.Vector) {
-	vecMat := linalg.NewMatrix(28*28, bayesFeatures)
-	for i := range vecMat.Data {
-		vecMat.Data[i] = rand.NormFloat64()
+func (b *Bayes) computeGaussians() {
+	floor := b.VarianceFloor
+	if floor == 0 {
+		floor = bayesVarianceFloor
+	}
+	var total [bayesFeatures]GaussianStats
+	for i, class := range b.Stats.Classes {
+		for j, stats := range class {
+			b.Classes[i][j] = stats.Gaussian(floor)
+			total[j].Merge(&stats)
+		}
 	}
-	for i := 0; i < bayesEigIterations; i++ {
-		product := mat.MulFast(vecMat)
-		vecMat, _ = qrdecomp.Householder(product)
+	for j, stats := range total {
+		b.Total[j] = stats.Gaussian(floor)
 	}
-	finalProduct := mat.MulFast(vecMat)
-	for i := 0; i < bayesFeatures; i++ {
-		col := finalProduct.Col(i)
-		vals = append(vals, col.Mag())
-		vecs = append(vecs, col)
+}
+
+// principalBasis computes a matrix whose rows are
+// the top bayesFeatures principal components of the
+// data.
+// If the data has fewer dimensions than that, the
+// remaining rows are zero.
+func principalBasis(data []linalg.Vector) *linalg.Matrix {
+	log.Println("Computing principal components...")
+	pca := FitPCA(data, &PCAConfig{
+		SampleCount: bayesCovarianceSamples,
+		Components:  bayesFeatures,
+	})
+	log.Println("Largest variance:", pca.Variances[0])
+	if pca.Components.Rows == bayesFeatures {
+		return pca.Components
 	}
-	return
+	res := linalg.NewMatrix(bayesFeatures, pca.Components.Cols)
+	copy(res.Data, pca.Components.Data)
+	return res
 }
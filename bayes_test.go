@@ -0,0 +1,34 @@
+package mnistdemo
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+func TestBayesUpdateSmallBatch(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(16))
+
+	b := &Bayes{
+		Basis: linalg.NewMatrix(bayesFeatures, 28*28),
+		Stats: &BayesStats{},
+	}
+	for i := 0; i < bayesFeatures; i++ {
+		b.Basis.Data[i*28*28+i] = 1
+	}
+	var data []*TrainingSample
+	for i := 0; i < 3; i++ {
+		s := new(Sample)
+		s[0] = float64(i)
+		data = append(data, &TrainingSample{Sample: s, Label: 1})
+	}
+	b.Update(data)
+
+	if count := b.Stats.Classes[1][0].Count; count != 3 {
+		t.Fatalf("expected 3 samples but got %f", count)
+	}
+	if mean := b.Classes[1][0].Mean; mean != 1 {
+		t.Errorf("expected mean 1 but got %f", mean)
+	}
+}
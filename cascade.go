@@ -0,0 +1,424 @@
+package mnistdemo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/unixpickle/serializer"
+)
+
+const (
+	cascadeSerializerID = "github.com/unixpickle/mnistdemo.Cascade"
+
+	cascadeDefaultSlack = 0.001
+	cascadeQuantiles    = 20
+	cascadeHoldout      = 0.1
+	cascadeMaxRounds    = 10
+)
+
+var cascadeDefaultStages = []string{"stumps", "neighbors"}
+
+func init() {
+	serializer.RegisterTypedDeserializer(cascadeSerializerID, DeserializeCascade)
+}
+
+// A Cascade tries a sequence of increasingly
+// expensive models, stopping at the first one which
+// is confident in its answer.
+//
+// Stages names the models in Classifiers, cheapest
+// first, defaulting to stumps and then neighbors.
+// Every stage but the last must be a Scorer, and its
+// confidence is the difference between its two
+// highest scores.
+//
+// Thresholds[i] is the confidence needed to stop at
+// stage i.
+// They are chosen to minimize the average time per
+// sample on a tenth of the training data, which the
+// models are not trained on, while reaching
+// TargetAccuracy, which defaults to the accuracy of
+// the last stage minus 0.1%.
+// Handled records the fraction of validation samples
+// which each stage answered.
+type Cascade struct {
+	Stages         []string
+	TargetAccuracy float64
+
+	Models     []Classifier
+	Thresholds []float64
+	Handled    []float64
+}
+
+// cascadeArchive is the serialized form of a Cascade,
+// with each model serialized with its type.
+type cascadeArchive struct {
+	Stages         []string
+	TargetAccuracy float64
+	Models         [][]byte
+	Thresholds     []cascadeThreshold
+	Handled        []float64
+}
+
+// cascadeThreshold is the serialized form of a
+// threshold, since JSON cannot encode the infinite
+// thresholds which always or never stop at a stage.
+type cascadeThreshold struct {
+	Value  float64 `json:",omitempty"`
+	Always bool    `json:",omitempty"`
+	Never  bool    `json:",omitempty"`
+}
+
+func newCascadeThreshold(t float64) cascadeThreshold {
+	switch {
+	case math.IsInf(t, -1):
+		return cascadeThreshold{Always: true}
+	case math.IsInf(t, 1):
+		return cascadeThreshold{Never: true}
+	default:
+		return cascadeThreshold{Value: t}
+	}
+}
+
+// UnmarshalJSON also accepts the plain numbers which
+// older models stored.
+func (c *cascadeThreshold) UnmarshalJSON(d []byte) error {
+	var value float64
+	if err := json.Unmarshal(d, &value); err == nil {
+		*c = cascadeThreshold{Value: value}
+		return nil
+	}
+	type plainThreshold cascadeThreshold
+	return json.Unmarshal(d, (*plainThreshold)(c))
+}
+
+func (c cascadeThreshold) Threshold() float64 {
+	switch {
+	case c.Always:
+		return math.Inf(-1)
+	case c.Never:
+		return math.Inf(1)
+	default:
+		return c.Value
+	}
+}
+
+// DeserializeCascade deserializes a Cascade that was
+// serialized with Cascade.Serialize().
+func DeserializeCascade(d []byte) (*Cascade, error) {
+	data, err := decompress(d)
+	if err != nil {
+		return nil, err
+	}
+	var archive cascadeArchive
+	if err := json.Unmarshal(data, &archive); err != nil {
+		return nil, err
+	}
+	res := &Cascade{
+		Stages:         archive.Stages,
+		TargetAccuracy: archive.TargetAccuracy,
+		Handled:        archive.Handled,
+	}
+	for _, t := range archive.Thresholds {
+		res.Thresholds = append(res.Thresholds, t.Threshold())
+	}
+	for _, modelData := range archive.Models {
+		model, err := deserializeClassifier(modelData)
+		if err != nil {
+			return nil, err
+		}
+		res.Models = append(res.Models, model)
+	}
+	return res, nil
+}
+
+// Validate checks that every stage is a known
+// classifier and that every stage but the last can
+// report its confidence, so that mistakes are caught
+// before any stage is trained.
+func (c *Cascade) Validate() error {
+	stages := c.stages()
+	for i, name := range stages {
+		desc, ok := Classifiers[name]
+		if !ok {
+			return errors.New("unknown classifier: " + name)
+		}
+		if _, ok := desc.Construct().(Scorer); !ok && i+1 < len(stages) {
+			return fmt.Errorf("stage %d (%s) cannot report its confidence", i+1, name)
+		}
+	}
+	return nil
+}
+
+// Train trains every stage and tunes the thresholds
+// on data held out from training.
+func (c *Cascade) Train(data, validation []*TrainingSample) {
+	if err := c.Validate(); err != nil {
+		panic(err)
+	}
+	data, heldOut := holdoutSplit(data, cascadeHoldout)
+	stages := c.stages()
+	c.Models = nil
+	for i, name := range stages {
+		log.Printf("Training stage %d (%s)...", i+1, name)
+		model := constructClassifier(name, "")
+		model.Train(data, validation)
+		c.Models = append(c.Models, model)
+	}
+
+	log.Println("Tuning thresholds...")
+	results := c.stageResults(heldOut)
+	target := c.TargetAccuracy
+	if target == 0 {
+		last := results[len(results)-1]
+		target = last.Accuracy(heldOut) - cascadeDefaultSlack
+	}
+	c.Thresholds = cascadeThresholds(results, heldOut, target)
+
+	log.Println("Running cross validation...")
+	var correct int
+	handled := make([]int, len(c.Models))
+	stageCorrect := make([]int, len(c.Models))
+	for _, x := range validation {
+		class, stage := c.classifyStage(x.Sample)
+		handled[stage]++
+		if class == x.Label {
+			correct++
+			stageCorrect[stage]++
+		}
+	}
+	c.Handled = make([]float64, len(c.Models))
+	for i, count := range handled {
+		c.Handled[i] = float64(count) / float64(len(validation))
+		log.Printf("Stage %d (%s): threshold %f, handled %.2f%% (%d/%d correct, %s/sample)",
+			i+1, stages[i], c.threshold(i), 100*c.Handled[i], stageCorrect[i], count,
+			time.Duration(results[i].Cost*float64(time.Second)))
+	}
+	log.Printf("Got %d/%d", correct, len(validation))
+}
+
+// Classify returns the answer of the first confident
+// stage.
+func (c *Cascade) Classify(s *Sample) int {
+	class, _ := c.classifyStage(s)
+	return class
+}
+
+// SerializerType returns the unique ID used to
+// serialize Cascades.
+func (c *Cascade) SerializerType() string {
+	return cascadeSerializerID
+}
+
+// Serialize serializes the thresholds along with
+// every model.
+func (c *Cascade) Serialize() ([]byte, error) {
+	archive := &cascadeArchive{
+		Stages:         c.Stages,
+		TargetAccuracy: c.TargetAccuracy,
+		Handled:        c.Handled,
+	}
+	for _, t := range c.Thresholds {
+		archive.Thresholds = append(archive.Thresholds, newCascadeThreshold(t))
+	}
+	for _, model := range c.Models {
+		modelData, err := serializer.SerializeWithType(model)
+		if err != nil {
+			return nil, err
+		}
+		archive.Models = append(archive.Models, modelData)
+	}
+	data, err := json.Marshal(archive)
+	if err != nil {
+		return nil, err
+	}
+	return compress(data), nil
+}
+
+// classifyStage classifies a sample and returns the
+// index of the stage which answered.
+func (c *Cascade) classifyStage(s *Sample) (class, stage int) {
+	for i, model := range c.Models[:len(c.Models)-1] {
+		scores := model.(Scorer).Scores(s)
+		class, confidence := scoreConfidence(scores)
+		if cascadeAccepts(confidence, c.threshold(i)) {
+			return class, i
+		}
+	}
+	return c.Models[len(c.Models)-1].Classify(s), len(c.Models) - 1
+}
+
+func (c *Cascade) stages() []string {
+	if len(c.Stages) == 0 {
+		return cascadeDefaultStages
+	}
+	return c.Stages
+}
+
+func (c *Cascade) threshold(stage int) float64 {
+	if stage < len(c.Thresholds) {
+		return c.Thresholds[stage]
+	}
+	return math.Inf(-1)
+}
+
+// cascadeStageResult stores one stage's answers and
+// confidences for every validation sample, along with
+// the average time the stage takes per sample.
+type cascadeStageResult struct {
+	Classes     []int
+	Confidences []float64
+	Cost        float64
+}
+
+func (c *cascadeStageResult) Accuracy(data []*TrainingSample) float64 {
+	var correct int
+	for i, x := range data {
+		if c.Classes[i] == x.Label {
+			correct++
+		}
+	}
+	return float64(correct) / float64(len(data))
+}
+
+// stageResults runs every stage on every sample.
+func (c *Cascade) stageResults(data []*TrainingSample) []*cascadeStageResult {
+	var res []*cascadeStageResult
+	for _, model := range c.Models {
+		result := &cascadeStageResult{
+			Classes:     make([]int, len(data)),
+			Confidences: make([]float64, len(data)),
+		}
+		start := time.Now()
+		for i, x := range data {
+			if scorer, ok := model.(Scorer); ok {
+				scores := scorer.Scores(x.Sample)
+				result.Classes[i], result.Confidences[i] = scoreConfidence(scores)
+			} else {
+				result.Classes[i] = model.Classify(x.Sample)
+			}
+		}
+		result.Cost = time.Since(start).Seconds() / float64(len(data))
+		res = append(res, result)
+	}
+	return res
+}
+
+// cascadeThresholds searches for the cheapest
+// thresholds which reach the target accuracy, or
+// else the most accurate ones.
+// Candidate thresholds are quantiles of each stage's
+// confidences, plus thresholds which accept or reject
+// every sample.
+//
+// Starting from a cascade which always defers to the
+// last stage, the search tunes one stage at a time
+// with the others fixed, until no stage improves.
+func cascadeThresholds(results []*cascadeStageResult, data []*TrainingSample,
+	target float64) []float64 {
+	var candidates [][]float64
+	for _, result := range results[:len(results)-1] {
+		sorted := append([]float64{}, result.Confidences...)
+		sort.Float64s(sorted)
+		stageCandidates := []float64{math.Inf(-1), math.Inf(1)}
+		for i := 1; i < cascadeQuantiles; i++ {
+			stageCandidates = append(stageCandidates, sorted[i*len(sorted)/cascadeQuantiles])
+		}
+		candidates = append(candidates, stageCandidates)
+	}
+
+	thresholds := make([]float64, len(candidates))
+	for i := range thresholds {
+		thresholds[i] = math.Inf(1)
+	}
+	bestAccuracy, bestCost := cascadeEvaluate(results, data, thresholds)
+	for round := 0; round < cascadeMaxRounds; round++ {
+		improved := false
+		for stage, stageCandidates := range candidates {
+			for _, t := range stageCandidates {
+				old := thresholds[stage]
+				thresholds[stage] = t
+				accuracy, cost := cascadeEvaluate(results, data, thresholds)
+				if cascadeBetter(accuracy, cost, bestAccuracy, bestCost, target) {
+					bestAccuracy, bestCost = accuracy, cost
+					improved = true
+				} else {
+					thresholds[stage] = old
+				}
+			}
+		}
+		if !improved {
+			break
+		}
+	}
+	if bestAccuracy < target {
+		log.Printf("Could not reach target accuracy %f (best %f)", target, bestAccuracy)
+	}
+	return thresholds
+}
+
+// cascadeBetter checks if one accuracy and cost are
+// preferable to another, favoring cost once the
+// target accuracy is reached.
+func cascadeBetter(accuracy, cost, bestAccuracy, bestCost, target float64) bool {
+	meets, bestMeets := accuracy >= target, bestAccuracy >= target
+	if meets != bestMeets {
+		return meets
+	}
+	if meets {
+		return cost < bestCost
+	}
+	return accuracy > bestAccuracy
+}
+
+// cascadeEvaluate computes the accuracy and average
+// cost per sample of a cascade with the given
+// thresholds.
+func cascadeEvaluate(results []*cascadeStageResult, data []*TrainingSample,
+	thresholds []float64) (accuracy, cost float64) {
+	var correct int
+	var totalCost float64
+	for i, x := range data {
+		for stage, result := range results {
+			totalCost += result.Cost
+			if stage == len(results)-1 || cascadeAccepts(result.Confidences[i], thresholds[stage]) {
+				if result.Classes[i] == x.Label {
+					correct++
+				}
+				break
+			}
+		}
+	}
+	return float64(correct) / float64(len(data)), totalCost / float64(len(data))
+}
+
+// cascadeAccepts checks if a stage with a given
+// confidence should answer.
+// An infinite threshold never accepts, even when the
+// confidence is infinite too.
+func cascadeAccepts(confidence, threshold float64) bool {
+	return !math.IsInf(threshold, 1) && confidence >= threshold
+}
+
+// scoreConfidence returns the class with the highest
+// score and its margin over the runner-up.
+func scoreConfidence(scores [10]float64) (class int, confidence float64) {
+	class = maxIndex(scores[:])
+	second := math.Inf(-1)
+	for i, x := range scores {
+		if i != class {
+			second = math.Max(second, x)
+		}
+	}
+	confidence = scores[class] - second
+	if math.IsNaN(confidence) {
+		// Every score is infinite.
+		confidence = 0
+	}
+	return class, confidence
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/unixpickle/mnist"
+	"github.com/unixpickle/mnistdemo"
+	"github.com/unixpickle/serializer"
+)
+
+func main() {
+	var bits int
+	var prune float64
+	var dataSet string
+	flag.IntVar(&bits, "bits", 8, "bits per weight (8 or 16)")
+	flag.Float64Var(&prune, "prune", 0, "fraction of each weight tensor to prune")
+	flag.StringVar(&dataSet, "data", "test", "data set for measuring accuracy (train or test)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <model_file> <output_file>\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Prunes and quantizes a trained neuralnet or rbf model.")
+		fmt.Fprintln(os.Stderr)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if prune < 0 || prune > 1 {
+		fmt.Fprintln(os.Stderr, "Prune fraction must be between 0 and 1:", prune)
+		os.Exit(1)
+	}
+
+	var samples []*mnistdemo.TrainingSample
+	switch dataSet {
+	case "train":
+		samples = mnistSamples(mnist.LoadTrainingDataSet())
+	case "test":
+		samples = mnistSamples(mnist.LoadTestingDataSet())
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown data set:", dataSet)
+		os.Exit(1)
+	}
+
+	inData, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to read model:", err)
+		os.Exit(1)
+	}
+	model, err := serializer.DeserializeWithType(inData)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to deserialize model:", err)
+		os.Exit(1)
+	}
+	classifier, ok := model.(mnistdemo.Classifier)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Model type %T is not a classifier.\n", model)
+		os.Exit(1)
+	}
+	before := accuracy(classifier, samples)
+
+	quantized, err := mnistdemo.QuantizeNet(classifier, bits, prune)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to quantize:", err)
+		os.Exit(1)
+	}
+	after := accuracy(quantized, samples)
+
+	outData, err := serializer.SerializeWithType(quantized)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to serialize:", err)
+		os.Exit(1)
+	}
+	if err := ioutil.WriteFile(flag.Arg(1), outData, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to save:", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Size: %d -> %d bytes (%.1f%%)\n", len(inData), len(outData),
+		100*float64(len(outData))/float64(len(inData)))
+	fmt.Printf("Accuracy on %s: %.4f -> %.4f (%+.4f)\n", dataSet, before, after,
+		after-before)
+}
+
+func accuracy(c mnistdemo.Classifier, samples []*mnistdemo.TrainingSample) float64 {
+	var correct int
+	for _, s := range samples {
+		if c.Classify(s.Sample) == s.Label {
+			correct++
+		}
+	}
+	return float64(correct) / float64(len(samples))
+}
+
+func mnistSamples(d mnist.DataSet) []*mnistdemo.TrainingSample {
+	var res []*mnistdemo.TrainingSample
+	for _, sample := range d.Samples {
+		ts := &mnistdemo.TrainingSample{
+			Label:  sample.Label,
+			Sample: new(mnistdemo.Sample),
+		}
+		copy(ts.Sample[:], sample.Intensities)
+		res = append(res, ts)
+	}
+	return res
+}
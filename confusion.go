@@ -0,0 +1,60 @@
+package mnistdemo
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A ConfusionMatrix counts how often samples of each
+// class (the row) were classified as each class (the
+// column).
+type ConfusionMatrix [10][10]int
+
+// Confusion classifies every sample and tallies the
+// results.
+func Confusion(c Classifier, data []*TrainingSample) *ConfusionMatrix {
+	var res ConfusionMatrix
+	for _, x := range data {
+		res[x.Label][c.Classify(x.Sample)]++
+	}
+	return &res
+}
+
+// Correct returns the number of correct
+// classifications.
+func (c *ConfusionMatrix) Correct() int {
+	var res int
+	for i := range c {
+		res += c[i][i]
+	}
+	return res
+}
+
+// Total returns the number of classifications.
+func (c *ConfusionMatrix) Total() int {
+	var res int
+	for _, row := range c {
+		for _, x := range row {
+			res += x
+		}
+	}
+	return res
+}
+
+// String formats the matrix as a table.
+func (c *ConfusionMatrix) String() string {
+	var lines []string
+	header := "    "
+	for i := range c {
+		header += fmt.Sprintf("%6d", i)
+	}
+	lines = append(lines, header)
+	for i, row := range c {
+		line := fmt.Sprintf("%4d", i)
+		for _, x := range row {
+			line += fmt.Sprintf("%6d", x)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
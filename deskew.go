@@ -0,0 +1,123 @@
+package mnistdemo
+
+import (
+	"encoding/json"
+	"math"
+
+	"github.com/unixpickle/serializer"
+)
+
+const deskewerSerializerID = "github.com/unixpickle/mnistdemo.Deskewer"
+
+func init() {
+	serializer.RegisterTypedDeserializer(deskewerSerializerID, DeserializeDeskewer)
+}
+
+// Deskew straightens slanted digits.
+//
+// It treats the image as a distribution of ink,
+// estimates the horizontal shear from the covariance
+// of the ink's coordinates, and undoes the shear with
+// bilinear interpolation.
+// The result is also translated to put the center of
+// mass in the center of the image.
+// Blank images are returned unchanged.
+func Deskew(s *Sample) *Sample {
+	cx, cy, shear, ok := skewMoments(s)
+	if !ok {
+		res := *s
+		return &res
+	}
+	const center = 13.5
+	res := new(Sample)
+	for y := 0; y < 28; y++ {
+		for x := 0; x < 28; x++ {
+			dy := float64(y) - center
+			srcX := cx + shear*dy + float64(x) - center
+			srcY := cy + dy
+			res[y*28+x] = s.bilinear(srcX, srcY)
+		}
+	}
+	return res
+}
+
+// SkewAngle estimates the slant of a digit in
+// radians, positive when the top leans right.
+func SkewAngle(s *Sample) float64 {
+	_, _, shear, _ := skewMoments(s)
+	return -math.Atan(shear)
+}
+
+// skewMoments computes the center of mass and the
+// horizontal shear of an image, which is the
+// covariance of x and y divided by the variance of
+// y.
+// It fails if the image has no vertical extent.
+func skewMoments(s *Sample) (cx, cy, shear float64, ok bool) {
+	var total float64
+	for y := 0; y < 28; y++ {
+		for x := 0; x < 28; x++ {
+			v := s[y*28+x]
+			total += v
+			cx += float64(x) * v
+			cy += float64(y) * v
+		}
+	}
+	if total == 0 {
+		return 0, 0, 0, false
+	}
+	cx /= total
+	cy /= total
+
+	var varY, covXY float64
+	for y := 0; y < 28; y++ {
+		for x := 0; x < 28; x++ {
+			v := s[y*28+x]
+			dy := float64(y) - cy
+			varY += dy * dy * v
+			covXY += (float64(x) - cx) * dy * v
+		}
+	}
+	if varY == 0 {
+		return cx, cy, 0, false
+	}
+	return cx, cy, covXY / varY, true
+}
+
+// A Deskewer is a Transformer which applies Deskew.
+type Deskewer struct{}
+
+// DeserializeDeskewer deserializes a Deskewer that
+// was serialized with Deskewer.Serialize().
+func DeserializeDeskewer(d []byte) (*Deskewer, error) {
+	data, err := decompress(d)
+	if err != nil {
+		return nil, err
+	}
+	var res Deskewer
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Fit does nothing, since Deskewer has no learned
+// parameters.
+func (d *Deskewer) Fit(data []*TrainingSample) {
+}
+
+func (d *Deskewer) Transform(s *Sample) *Sample {
+	return Deskew(s)
+}
+
+func (d *Deskewer) SerializerType() string {
+	return deskewerSerializerID
+}
+
+func (d *Deskewer) Serialize() ([]byte, error) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	return compress(data), nil
+}
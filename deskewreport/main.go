@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/unixpickle/mnist"
+	"github.com/unixpickle/mnistdemo"
+)
+
+func main() {
+	var classifiers string
+	var trainCount int
+	flag.StringVar(&classifiers, "classifiers", "bayes,lda,softmax,stumps,neighbors",
+		"comma-separated classifiers to compare")
+	flag.IntVar(&trainCount, "samples", 0, "training samples to use (0 for all)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags]\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Trains each classifier with and without deskewing and")
+		fmt.Fprintln(os.Stderr, "reports the test accuracy of both.")
+		fmt.Fprintln(os.Stderr)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var names []string
+	for _, name := range strings.Split(classifiers, ",") {
+		name = strings.TrimSpace(name)
+		names = append(names, name)
+		if _, ok := mnistdemo.Classifiers[name]; !ok {
+			fmt.Fprintln(os.Stderr, "Unknown classifier:", name)
+			os.Exit(1)
+		}
+	}
+
+	training := mnistSamples(mnist.LoadTrainingDataSet())
+	if trainCount > 0 && trainCount < len(training) {
+		training = training[:trainCount]
+	}
+	testing := mnistSamples(mnist.LoadTestingDataSet())
+
+	var before, after float64
+	for _, x := range testing {
+		before += math.Abs(mnistdemo.SkewAngle(x.Sample))
+		after += math.Abs(mnistdemo.SkewAngle(mnistdemo.Deskew(x.Sample)))
+	}
+	toDegrees := 180 / math.Pi / float64(len(testing))
+
+	var lines []string
+	for _, name := range names {
+		raw := mnistdemo.Classifiers[name].Construct()
+		raw.Train(training, testing)
+		deskewed := &mnistdemo.Pipeline{
+			Stages: []string{"deskew"},
+			Inner:  name,
+			Model:  mnistdemo.Classifiers[name].Construct(),
+		}
+		deskewed.Train(training, testing)
+
+		rawErr := 1 - accuracy(raw, testing)
+		deskewedErr := 1 - accuracy(deskewed, testing)
+		// The relative change is undefined without raw
+		// errors.
+		change := "n/a"
+		if rawErr > 0 {
+			change = fmt.Sprintf("%+.2f%%", 100*(deskewedErr-rawErr)/rawErr)
+		}
+		lines = append(lines, fmt.Sprintf("%-20s %9.2f%% %9.2f%% %10s", name,
+			100*rawErr, 100*deskewedErr, change))
+	}
+
+	fmt.Printf("Mean absolute skew: %.2f -> %.2f degrees\n\n", before*toDegrees,
+		after*toDegrees)
+	fmt.Printf("%-20s %10s %10s %10s\n", "classifier", "raw err", "deskew err", "change")
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+}
+
+func accuracy(c mnistdemo.Classifier, samples []*mnistdemo.TrainingSample) float64 {
+	var correct int
+	for _, s := range samples {
+		if c.Classify(s.Sample) == s.Label {
+			correct++
+		}
+	}
+	return float64(correct) / float64(len(samples))
+}
+
+func mnistSamples(d mnist.DataSet) []*mnistdemo.TrainingSample {
+	var res []*mnistdemo.TrainingSample
+	for _, sample := range d.Samples {
+		ts := &mnistdemo.TrainingSample{
+			Label:  sample.Label,
+			Sample: new(mnistdemo.Sample),
+		}
+		copy(ts.Sample[:], sample.Intensities)
+		res = append(res, ts)
+	}
+	return res
+}
@@ -0,0 +1,214 @@
+package mnistdemo
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"strconv"
+
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+)
+
+const (
+	discriminantSerializerID = "github.com/unixpickle/mnistdemo.Discriminant"
+	discriminantShrinkage    = 0.1
+	discriminantRidge        = 1e-6
+)
+
+func init() {
+	serializer.RegisterTypedDeserializer(discriminantSerializerID,
+		DeserializeDiscriminant)
+}
+
+// A Discriminant performs Gaussian discriminant
+// analysis on the same PCA features as Bayes, but
+// with full covariance matrices.
+//
+// If Shared is true, every class uses one pooled
+// covariance matrix (linear discriminant analysis).
+// Otherwise, each class has its own covariance
+// (quadratic discriminant analysis).
+//
+// Shrinkage blends each covariance with a spherical
+// covariance of the same trace.
+type Discriminant struct {
+	Shared    bool
+	Shrinkage float64
+
+	Basis     *linalg.Matrix
+	Means     [10]linalg.Vector
+	LogPriors [10]float64
+
+	// Factors stores the Cholesky factor of each
+	// class's covariance matrix.
+	// When Shared is true, only Factors[0] is set.
+	Factors [10]*linalg.Matrix
+	LogDets [10]float64
+}
+
+// DeserializeDiscriminant deserializes a
+// Discriminant that was serialized with
+// Discriminant.Serialize().
+func DeserializeDiscriminant(d []byte) (*Discriminant, error) {
+	var res Discriminant
+	data, err := decompress(d)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Train fits the class means and covariances.
+func (d *Discriminant) Train(data, validation []*TrainingSample) {
+	log.Println("Computing basis features...")
+	d.Basis = principalBasis(trainingVectors(data))
+
+	log.Println("Computing class statistics...")
+	features := make([]linalg.Vector, len(data))
+	for i, x := range data {
+		features[i] = d.features(x.Sample)
+	}
+	var counts [10]int
+	for i, x := range data {
+		if d.Means[x.Label] == nil {
+			d.Means[x.Label] = make(linalg.Vector, bayesFeatures)
+		}
+		counts[x.Label]++
+		for j, f := range features[i] {
+			d.Means[x.Label][j] += f
+		}
+	}
+	for i, mean := range d.Means {
+		d.LogPriors[i] = logPrior(counts[i], len(data))
+		if mean == nil {
+			d.Means[i] = make(linalg.Vector, bayesFeatures)
+			continue
+		}
+		for j := range mean {
+			mean[j] /= float64(counts[i])
+		}
+	}
+
+	var covs [10]*linalg.Matrix
+	for i := range covs {
+		covs[i] = linalg.NewMatrix(bayesFeatures, bayesFeatures)
+	}
+	for i, x := range data {
+		cov := covs[x.Label]
+		if d.Shared {
+			cov = covs[0]
+		}
+		mean := d.Means[x.Label]
+		for j := 0; j < bayesFeatures; j++ {
+			dj := features[i][j] - mean[j]
+			for k := 0; k < bayesFeatures; k++ {
+				cov.Data[j*bayesFeatures+k] += dj * (features[i][k] - mean[k])
+			}
+		}
+	}
+
+	log.Println("Factorizing covariances...")
+	for i, cov := range covs {
+		count := counts[i]
+		if d.Shared {
+			if i > 0 {
+				break
+			}
+			count = len(data)
+		}
+		if count == 0 {
+			continue
+		}
+		for j := range cov.Data {
+			cov.Data[j] /= float64(count)
+		}
+		shrinkCovariance(cov, d.Shrinkage)
+		for j := 0; j < bayesFeatures; j++ {
+			cov.Data[j*bayesFeatures+j] += discriminantRidge
+		}
+		factor, err := cholesky(cov)
+		if err != nil {
+			panic("covariance for class " + strconv.Itoa(i) + ": " + err.Error())
+		}
+		d.Factors[i] = factor
+		d.LogDets[i] = choleskyLogDet(factor)
+	}
+
+	log.Println("Running cross validation...")
+	var correct int
+	for _, s := range validation {
+		if d.Classify(s.Sample) == s.Label {
+			correct++
+		}
+	}
+	log.Printf("Got %d/%d", correct, len(validation))
+}
+
+// Classify returns the class with the highest
+// posterior log-likelihood.
+func (d *Discriminant) Classify(s *Sample) int {
+	scores := d.Scores(s)
+	return maxIndex(scores[:])
+}
+
+// Scores computes the log posterior of each class,
+// up to a constant.
+func (d *Discriminant) Scores(s *Sample) [10]float64 {
+	features := d.features(s)
+	var res [10]float64
+	diff := make([]float64, len(features))
+	for i := 0; i < 10; i++ {
+		factor, logDet := d.Factors[i], d.LogDets[i]
+		if d.Shared {
+			factor, logDet = d.Factors[0], d.LogDets[0]
+		}
+		if factor == nil || d.LogPriors[i] == absentLogPrior {
+			res[i] = math.Inf(-1)
+			continue
+		}
+		for j, x := range features {
+			diff[j] = x - d.Means[i][j]
+		}
+		res[i] = d.LogPriors[i] - 0.5*logDet -
+			0.5*choleskyMahalanobis(factor, diff)
+	}
+	return res
+}
+
+// SerializerType returns the unique ID used to
+// serialize Discriminants.
+func (d *Discriminant) SerializerType() string {
+	return discriminantSerializerID
+}
+
+// Serialize serializes the model's parameters.
+func (d *Discriminant) Serialize() ([]byte, error) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	return compress(data), nil
+}
+
+func (d *Discriminant) features(s *Sample) linalg.Vector {
+	return d.Basis.MulFast(linalg.NewMatrixColumn(s[:])).Data
+}
+
+// absentLogPrior is the log prior stored for a class
+// with no training samples, since JSON cannot encode
+// negative infinity.
+const absentLogPrior = -math.MaxFloat64
+
+// logPrior computes the log prior of a class with
+// count of total samples, or absentLogPrior if the
+// class has no samples.
+func logPrior(count, total int) float64 {
+	if count == 0 {
+		return absentLogPrior
+	}
+	return math.Log(float64(count) / float64(total))
+}
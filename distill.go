@@ -0,0 +1,112 @@
+package mnistdemo
+
+import (
+	"math"
+	"math/rand"
+)
+
+// SoftLabels computes distillation targets for each
+// sample by averaging the teachers' distributions.
+//
+// Each teacher's distribution is the softmax of its
+// scores divided by temperature, so its scores must
+// be log probabilities (see HasLogProbScores).
+// This is the teacher's own distribution at a
+// temperature of 1, and higher temperatures give
+// softer targets.
+func SoftLabels(teachers []Scorer, data []*Sample, temperature float64) []*SoftSample {
+	res := make([]*SoftSample, len(data))
+	parallelFor(len(data), func(i int) {
+		soft := &SoftSample{Sample: data[i]}
+		for _, teacher := range teachers {
+			scores := teacher.Scores(data[i])
+			for j, x := range scores {
+				scores[j] = x / temperature
+			}
+			for j, p := range softmaxProbs(scores) {
+				soft.Probs[j] += p / float64(len(teachers))
+			}
+		}
+		res[i] = soft
+	})
+	return res
+}
+
+// HasLogProbScores checks if a model's scores are log
+// probabilities up to a constant, so that it can be
+// a teacher for SoftLabels.
+// The scores of Bayes are scaled by two, so they
+// give its own distribution at a temperature of 2.
+func HasLogProbScores(model Scorer) bool {
+	switch model.(type) {
+	case *NeuralNet, *Softmax, *Bayes, *Discriminant, *GMM, *PixelBayes:
+		return true
+	}
+	return false
+}
+
+// HardSoftSamples converts labelled samples to
+// one-hot SoftSamples.
+func HardSoftSamples(data []*TrainingSample) []*SoftSample {
+	res := make([]*SoftSample, len(data))
+	for i, x := range data {
+		res[i] = &SoftSample{Sample: x.Sample}
+		res[i].Probs[x.Label] = 1
+	}
+	return res
+}
+
+// Label returns the most likely class.
+func (s *SoftSample) Label() int {
+	return maxIndex(s.Probs[:])
+}
+
+// Entropy returns the entropy of the targets in
+// nats.
+func (s *SoftSample) Entropy() float64 {
+	var res float64
+	for _, p := range s.Probs {
+		if p > 0 {
+			res -= p * math.Log(p)
+		}
+	}
+	return res
+}
+
+// hardSamples labels each sample with its most likely
+// class.
+func hardSamples(data []*SoftSample) []*TrainingSample {
+	res := make([]*TrainingSample, len(data))
+	for i, x := range data {
+		res[i] = &TrainingSample{Sample: x.Sample, Label: x.Label()}
+	}
+	return res
+}
+
+// drawnSamples labels each sample with a class drawn
+// from its targets.
+func drawnSamples(data []*SoftSample, gen *rand.Rand) []*TrainingSample {
+	res := make([]*TrainingSample, len(data))
+	for i, x := range data {
+		label := x.Label()
+		r := gen.Float64()
+		for class, p := range x.Probs {
+			r -= p
+			if r < 0 {
+				label = class
+				break
+			}
+		}
+		res[i] = &TrainingSample{Sample: x.Sample, Label: label}
+	}
+	return res
+}
+
+// softTargets extracts the target distributions.
+func softTargets(data []*SoftSample) [][10]float64 {
+	res := make([][10]float64, len(data))
+	for i, x := range data {
+		res[i] = x.Probs
+	}
+	return res
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/unixpickle/mnist"
+	"github.com/unixpickle/mnistdemo"
+	"github.com/unixpickle/serializer"
+)
+
+func main() {
+	var temperature float64
+	var augmented, mixup int
+	var augment string
+	var seed int64
+	var stumpFamilies string
+	var softmaxPCA int
+	trainConfig := mnistdemo.DefaultTrainConfig()
+	flag.Float64Var(&temperature, "temperature", 1,
+		"softmax temperature for the teacher's scores")
+	flag.IntVar(&augmented, "augmented", 0,
+		"augmented training samples to add to the transfer set")
+	flag.StringVar(&augment, "augment", "affine",
+		"comma-separated augmenters for the augmented samples")
+	flag.IntVar(&mixup, "mixup", 0,
+		"blends of two training samples to add to the transfer set")
+	flag.Int64Var(&seed, "seed", time.Now().UnixNano(), "random seed for extra samples")
+	flag.StringVar(&stumpFamilies, "stump-families", "",
+		"comma-separated weak learner families for stumps (pixel, pair, haar)")
+	flag.IntVar(&softmaxPCA, "softmax-pca", -1,
+		"principal components for softmax (0 for raw pixels, -1 for the classifier default)")
+	flag.StringVar(&trainConfig.Optimizer, "optimizer", trainConfig.Optimizer,
+		"optimizer for networks (sgd, momentum, nesterov, rmsprop, adam)")
+	flag.Float64Var(&trainConfig.StepSize, "step", trainConfig.StepSize, "SGD step size")
+	flag.IntVar(&trainConfig.BatchSize, "batch", trainConfig.BatchSize, "SGD batch size")
+	flag.IntVar(&trainConfig.Epochs, "epochs", 0, "training epochs (0 to train until ctrl+c)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <student> <output_file> <teacher_file> ...\n\n",
+			os.Args[0])
+		fmt.Fprintln(os.Stderr, "Trains a student classifier on the soft labels of one or more")
+		fmt.Fprintln(os.Stderr, "teachers, averaging the teachers' distributions.")
+		fmt.Fprintln(os.Stderr, "Teachers must score classes with log probabilities: neuralnet,")
+		fmt.Fprintln(os.Stderr, "softmax, bayes, lda, qda, gmm, bernoulli-bayes or multinomial-bayes.")
+		printStudents()
+		fmt.Fprintln(os.Stderr, "Flags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 3 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	desc, ok := mnistdemo.Classifiers[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Unknown classifier:", flag.Arg(0))
+		os.Exit(1)
+	}
+	student, ok := desc.Construct().(mnistdemo.SoftTrainer)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Classifier cannot be distilled into:", flag.Arg(0))
+		os.Exit(1)
+	}
+	if stumps, ok := student.(*mnistdemo.Stumps); ok && stumpFamilies != "" {
+		stumps.Families = strings.Split(stumpFamilies, ",")
+	}
+	if net, ok := student.(*mnistdemo.NeuralNet); ok {
+		net.Config = trainConfig
+	}
+	if softmax, ok := student.(*mnistdemo.Softmax); ok && softmaxPCA >= 0 {
+		softmax.PCAComponents = softmaxPCA
+	}
+
+	var teachers []mnistdemo.Scorer
+	var teacherSize int
+	for _, path := range flag.Args()[2:] {
+		teacher, size, err := loadTeacher(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to load teacher:", err)
+			os.Exit(1)
+		}
+		teachers = append(teachers, teacher)
+		teacherSize += size
+	}
+
+	training := mnistSamples(mnist.LoadTrainingDataSet())
+	validation := mnistSamples(mnist.LoadTestingDataSet())
+
+	aug, err := mnistdemo.ParseAugmenter(augment)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	gen := rand.New(rand.NewSource(seed))
+	var inputs []*mnistdemo.Sample
+	for _, x := range training {
+		inputs = append(inputs, x.Sample)
+	}
+	for i := 0; i < augmented; i++ {
+		inputs = append(inputs, aug.Augment(training[gen.Intn(len(training))].Sample, gen))
+	}
+	for i := 0; i < mixup; i++ {
+		a := training[gen.Intn(len(training))].Sample
+		b := training[gen.Intn(len(training))].Sample
+		inputs = append(inputs, mixSamples(a, b, gen.Float64()))
+	}
+
+	log.Printf("Labelling %d samples with %d teacher(s)...", len(inputs), len(teachers))
+	transfer := mnistdemo.SoftLabels(teachers, inputs, temperature)
+	var entropy float64
+	for _, x := range transfer {
+		entropy += x.Entropy()
+	}
+	log.Printf("Mean target entropy: %f nats", entropy/float64(len(transfer)))
+
+	student.TrainSoft(transfer, validation)
+
+	resData, err := serializer.SerializeWithType(student)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to serialize:", err)
+		os.Exit(1)
+	}
+	if err := ioutil.WriteFile(flag.Arg(1), resData, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to save:", err)
+		os.Exit(1)
+	}
+
+	teacherAcc := ensembleAccuracy(teachers, validation)
+	studentAcc := accuracy(student, validation)
+	fmt.Printf("Size: %d -> %d bytes (%.1f%%)\n", teacherSize, len(resData),
+		100*float64(len(resData))/float64(teacherSize))
+	fmt.Printf("Accuracy: %.4f -> %.4f (%+.4f)\n", teacherAcc, studentAcc,
+		studentAcc-teacherAcc)
+}
+
+func loadTeacher(path string) (mnistdemo.Scorer, int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	model, err := serializer.DeserializeWithType(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	scorer, ok := model.(mnistdemo.Scorer)
+	if !ok {
+		return nil, 0, fmt.Errorf("model type %T cannot score classes", model)
+	}
+	if !mnistdemo.HasLogProbScores(scorer) {
+		return nil, 0, fmt.Errorf("model type %T does not score classes with log probabilities",
+			model)
+	}
+	return scorer, len(data), nil
+}
+
+func printStudents() {
+	var names []string
+	for name, desc := range mnistdemo.Classifiers {
+		if _, ok := desc.Construct().(mnistdemo.SoftTrainer); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "\nAvailable students:")
+	for _, name := range names {
+		desc := mnistdemo.Classifiers[name].Desc
+		fmt.Fprintf(os.Stderr, " %s - %s\n", name, desc)
+	}
+	fmt.Fprintln(os.Stderr)
+}
+
+// mixSamples blends two samples, which gives inputs
+// that the teacher is unsure about.
+func mixSamples(a, b *mnistdemo.Sample, frac float64) *mnistdemo.Sample {
+	res := new(mnistdemo.Sample)
+	for i := range res {
+		res[i] = frac*a[i] + (1-frac)*b[i]
+	}
+	return res
+}
+
+func ensembleAccuracy(teachers []mnistdemo.Scorer, samples []*mnistdemo.TrainingSample) float64 {
+	inputs := make([]*mnistdemo.Sample, len(samples))
+	for i, s := range samples {
+		inputs[i] = s.Sample
+	}
+	var correct int
+	for i, soft := range mnistdemo.SoftLabels(teachers, inputs, 1) {
+		if soft.Label() == samples[i].Label {
+			correct++
+		}
+	}
+	return float64(correct) / float64(len(samples))
+}
+
+func accuracy(c mnistdemo.Classifier, samples []*mnistdemo.TrainingSample) float64 {
+	var correct int
+	for _, s := range samples {
+		if c.Classify(s.Sample) == s.Label {
+			correct++
+		}
+	}
+	return float64(correct) / float64(len(samples))
+}
+
+func mnistSamples(d mnist.DataSet) []*mnistdemo.TrainingSample {
+	var res []*mnistdemo.TrainingSample
+	for _, sample := range d.Samples {
+		ts := &mnistdemo.TrainingSample{
+			Label:  sample.Label,
+			Sample: new(mnistdemo.Sample),
+		}
+		copy(ts.Sample[:], sample.Intensities)
+		res = append(res, ts)
+	}
+	return res
+}
@@ -0,0 +1,330 @@
+package mnistdemo
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+
+	"github.com/unixpickle/serializer"
+)
+
+const (
+	ecocSerializerID = "github.com/unixpickle/mnistdemo.ECOC"
+
+	ecocDefaultBase    = "stumps"
+	ecocDefaultColumns = 30
+	ecocRandomTrials   = 1000
+)
+
+// Code matrices for ECOC.
+const (
+	ECOCOneVsRest  = "ovr"
+	ECOCOneVsOne   = "ovo"
+	ECOCRandom     = "random"
+	ECOCExhaustive = "exhaustive"
+)
+
+// Decoding methods for ECOC.
+const (
+	ECOCHamming = "hamming"
+	ECOCLoss    = "loss"
+)
+
+func init() {
+	serializer.RegisterTypedDeserializer(ecocSerializerID, DeserializeECOC)
+}
+
+// ECOC is an error-correcting output code classifier,
+// which combines binary classifiers that each
+// separate one group of classes from another.
+//
+// Every column of Matrix assigns each class a code
+// of 1, -1, or 0 (ignored), and Learners[i] is
+// trained on column i.
+//
+// Base names the binary classifier in
+// BinaryClassifiers, defaulting to "stumps".
+// Code selects the code matrix (ECOCOneVsRest,
+// ECOCOneVsOne, ECOCRandom or ECOCExhaustive),
+// defaulting to a dense random code with Columns
+// columns (default 30).
+// The exhaustive code has 511 columns, so it is very
+// slow to train.
+// Decoding is ECOCLoss (the default) to pick the
+// class whose code has the smallest exponential loss
+// against the margins, or ECOCHamming to pick the
+// class with the fewest disagreeing signs, breaking
+// ties by loss.
+type ECOC struct {
+	Base     string
+	Code     string
+	Decoding string
+	Columns  int
+
+	Matrix   [][10]int
+	Learners []BinaryClassifier
+}
+
+// ecocArchive is the serialized form of an ECOC,
+// with each learner serialized with its type.
+type ecocArchive struct {
+	Base     string
+	Code     string
+	Decoding string
+	Columns  int
+	Matrix   [][10]int
+	Learners [][]byte
+}
+
+// DeserializeECOC deserializes an ECOC that was
+// serialized with ECOC.Serialize().
+func DeserializeECOC(d []byte) (*ECOC, error) {
+	data, err := decompress(d)
+	if err != nil {
+		return nil, err
+	}
+	var archive ecocArchive
+	if err := json.Unmarshal(data, &archive); err != nil {
+		return nil, err
+	}
+	res := &ECOC{
+		Base:     archive.Base,
+		Code:     archive.Code,
+		Decoding: archive.Decoding,
+		Columns:  archive.Columns,
+		Matrix:   archive.Matrix,
+	}
+	for _, learnerData := range archive.Learners {
+		obj, err := serializer.DeserializeWithType(learnerData)
+		if err != nil {
+			return nil, err
+		}
+		learner, ok := obj.(BinaryClassifier)
+		if !ok {
+			return nil, fmt.Errorf("not a binary classifier: %T", obj)
+		}
+		res.Learners = append(res.Learners, learner)
+	}
+	return res, nil
+}
+
+// Train builds the code matrix and trains a learner
+// for each of its columns.
+func (e *ECOC) Train(data, validation []*TrainingSample) {
+	baseName := e.Base
+	if baseName == "" {
+		baseName = ecocDefaultBase
+	}
+	base, ok := BinaryClassifiers[baseName]
+	if !ok {
+		panic("unknown binary classifier: " + baseName)
+	}
+
+	switch e.Code {
+	case ECOCOneVsRest:
+		e.Matrix = ecocOneVsRest()
+	case ECOCOneVsOne:
+		e.Matrix = ecocOneVsOne()
+	case "", ECOCRandom:
+		columns := e.Columns
+		if columns == 0 {
+			columns = ecocDefaultColumns
+		}
+		e.Matrix = ecocRandomCode(columns)
+	case ECOCExhaustive:
+		e.Matrix = ecocExhaustive()
+	default:
+		panic("unknown code matrix: " + e.Code)
+	}
+	log.Printf("Code has %d columns with minimum distance %d.", len(e.Matrix),
+		ecocMinDistance(e.Matrix))
+
+	e.Learners = nil
+	for i, column := range e.Matrix {
+		var subset []*TrainingSample
+		var targets []float64
+		for _, x := range data {
+			if code := column[x.Label]; code != 0 {
+				subset = append(subset, x)
+				targets = append(targets, float64(code))
+			}
+		}
+		log.Printf("Training column %d/%d on %d samples...", i+1, len(e.Matrix),
+			len(subset))
+		learner := base.Construct()
+		learner.TrainBinary(subset, targets)
+		e.Learners = append(e.Learners, learner)
+	}
+
+	log.Println("Running cross validation...")
+	var correct int
+	for _, x := range validation {
+		if e.Classify(x.Sample) == x.Label {
+			correct++
+		}
+	}
+	log.Printf("Got %d/%d", correct, len(validation))
+}
+
+// Classify decodes the margins of the learners.
+func (e *ECOC) Classify(s *Sample) int {
+	margins := make([]float64, len(e.Learners))
+	for i, learner := range e.Learners {
+		margins[i] = learner.Margin(s)
+	}
+
+	var losses, hamming [10]float64
+	for i, column := range e.Matrix {
+		for class, code := range column {
+			losses[class] += math.Exp(-float64(code) * margins[i])
+			if code == 0 || margins[i] == 0 {
+				hamming[class] += 0.5
+			} else if (code > 0) != (margins[i] > 0) {
+				hamming[class]++
+			}
+		}
+	}
+
+	var best int
+	for class := range losses {
+		if e.Decoding == ECOCHamming && hamming[class] != hamming[best] {
+			if hamming[class] < hamming[best] {
+				best = class
+			}
+		} else if losses[class] < losses[best] {
+			best = class
+		}
+	}
+	return best
+}
+
+// SerializerType returns the unique ID used to
+// serialize ECOCs.
+func (e *ECOC) SerializerType() string {
+	return ecocSerializerID
+}
+
+// Serialize serializes the code matrix along with
+// every learner.
+func (e *ECOC) Serialize() ([]byte, error) {
+	archive := &ecocArchive{
+		Base:     e.Base,
+		Code:     e.Code,
+		Decoding: e.Decoding,
+		Columns:  e.Columns,
+		Matrix:   e.Matrix,
+	}
+	for _, learner := range e.Learners {
+		learnerData, err := serializer.SerializeWithType(learner)
+		if err != nil {
+			return nil, err
+		}
+		archive.Learners = append(archive.Learners, learnerData)
+	}
+	data, err := json.Marshal(archive)
+	if err != nil {
+		return nil, err
+	}
+	return compress(data), nil
+}
+
+func ecocOneVsRest() [][10]int {
+	var res [][10]int
+	for class := 0; class < 10; class++ {
+		var column [10]int
+		for i := range column {
+			column[i] = -1
+		}
+		column[class] = 1
+		res = append(res, column)
+	}
+	return res
+}
+
+func ecocOneVsOne() [][10]int {
+	var res [][10]int
+	for pos := 0; pos < 10; pos++ {
+		for neg := pos + 1; neg < 10; neg++ {
+			var column [10]int
+			column[pos] = 1
+			column[neg] = -1
+			res = append(res, column)
+		}
+	}
+	return res
+}
+
+// ecocExhaustive generates every distinct split of
+// the classes into two non-empty groups.
+func ecocExhaustive() [][10]int {
+	var res [][10]int
+	for bits := 0; bits < 1<<9-1; bits++ {
+		column := [10]int{1}
+		for class := 1; class < 10; class++ {
+			if bits&(1<<uint(class-1)) != 0 {
+				column[class] = 1
+			} else {
+				column[class] = -1
+			}
+		}
+		res = append(res, column)
+	}
+	return res
+}
+
+// ecocRandomCode generates random dense codes and
+// keeps the one whose rows are furthest apart.
+// Columns which are constant, or which repeat or
+// negate another column, are never used.
+func ecocRandomCode(columns int) [][10]int {
+	var best [][10]int
+	bestDist := -1
+	for trial := 0; trial < ecocRandomTrials; trial++ {
+		var code [][10]int
+		seen := map[[10]int]bool{}
+		for attempts := 0; len(code) < columns && attempts < columns*100; attempts++ {
+			var column, negated [10]int
+			var positive int
+			for i := range column {
+				if rand.Intn(2) == 0 {
+					column[i] = 1
+					positive++
+				} else {
+					column[i] = -1
+				}
+				negated[i] = -column[i]
+			}
+			if positive == 0 || positive == 10 || seen[column] {
+				continue
+			}
+			seen[column] = true
+			seen[negated] = true
+			code = append(code, column)
+		}
+		if dist := ecocMinDistance(code); dist > bestDist {
+			best = code
+			bestDist = dist
+		}
+	}
+	return best
+}
+
+// ecocMinDistance computes the minimum number of
+// columns in which two classes have opposite codes.
+func ecocMinDistance(code [][10]int) int {
+	res := len(code)
+	for c1 := 0; c1 < 10; c1++ {
+		for c2 := c1 + 1; c2 < 10; c2++ {
+			var dist int
+			for _, column := range code {
+				if column[c1]*column[c2] < 0 {
+					dist++
+				}
+			}
+			res = minInt(res, dist)
+		}
+	}
+	return res
+}
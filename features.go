@@ -0,0 +1,288 @@
+package mnistdemo
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+// Default settings for ParseFeatureExtractor.
+const (
+	hogDefaultCellSize     = 7
+	hogDefaultBlockSize    = 2
+	hogDefaultBins         = 9
+	featureDefaultZones    = 7
+	featureDefaultProjBins = 14
+
+	hogClip = 0.2
+)
+
+// A FeatureExtractor computes a feature vector from a
+// sample, for learners which would otherwise see raw
+// pixels.
+//
+// The vector concatenates HOG descriptors (if HOG is
+// set), the mean intensity in each cell of a Zones by
+// Zones grid (if Zones is non-zero), and horizontal
+// and vertical projection histograms with
+// Projections bins each (if Projections is non-zero).
+// Every feature is between 0 and 1.
+//
+// A nil *FeatureExtractor stands for the raw pixels.
+type FeatureExtractor struct {
+	HOG         *HOG `json:",omitempty"`
+	Zones       int  `json:",omitempty"`
+	Projections int  `json:",omitempty"`
+
+	// net, if set, replaces the other features with
+	// the outputs of a truncated network.
+	// It is not serialized, so NetFeatures sets it
+	// again after deserializing.
+	net    *NeuralNet
+	netDim int
+}
+
+// HOG configures histogram-of-oriented-gradients
+// descriptors.
+//
+// Gradient orientations are binned into Bins unsigned
+// orientations within each CellSize by CellSize
+// cell.
+// Each BlockSize by BlockSize group of cells is then
+// normalized with L2-Hys, and blocks overlap with a
+// stride of one cell.
+type HOG struct {
+	CellSize  int
+	BlockSize int
+	Bins      int
+}
+
+// ParseFeatureExtractor creates a FeatureExtractor
+// with default settings from a comma-separated list
+// of "hog", "zoning" and "projection".
+func ParseFeatureExtractor(spec string) (*FeatureExtractor, error) {
+	res := &FeatureExtractor{}
+	for _, name := range strings.Split(spec, ",") {
+		switch strings.TrimSpace(name) {
+		case "hog":
+			res.HOG = &HOG{
+				CellSize:  hogDefaultCellSize,
+				BlockSize: hogDefaultBlockSize,
+				Bins:      hogDefaultBins,
+			}
+		case "zoning":
+			res.Zones = featureDefaultZones
+		case "projection":
+			res.Projections = featureDefaultProjBins
+		default:
+			return nil, fmt.Errorf("unknown features: %s", name)
+		}
+	}
+	return res, nil
+}
+
+// netFeatureExtractor creates a FeatureExtractor
+// whose features are a network's outputs.
+func netFeatureExtractor(net *NeuralNet) *FeatureExtractor {
+	return &FeatureExtractor{net: net, netDim: len(net.Output(&Sample{}))}
+}
+
+// Validate checks that every size is usable with
+// 28x28 samples.
+func (f *FeatureExtractor) Validate() error {
+	if h := f.HOG; h != nil {
+		if h.CellSize < 1 || h.CellSize > 28 {
+			return fmt.Errorf("HOG cell size must be between 1 and 28: %d", h.CellSize)
+		}
+		if h.BlockSize < 1 || h.BlockSize > h.cells() {
+			return fmt.Errorf("HOG block size must be between 1 and %d cells: %d",
+				h.cells(), h.BlockSize)
+		}
+		if h.Bins < 1 {
+			return fmt.Errorf("HOG needs at least one bin: %d", h.Bins)
+		}
+	}
+	if f.Zones < 0 || f.Zones > 28 {
+		return fmt.Errorf("zones must be between 0 and 28: %d", f.Zones)
+	}
+	if f.Projections < 0 || f.Projections > 28 {
+		return fmt.Errorf("projection bins must be between 0 and 28: %d", f.Projections)
+	}
+	return nil
+}
+
+// Dim returns the length of the feature vectors.
+func (f *FeatureExtractor) Dim() int {
+	if f == nil {
+		return 28 * 28
+	}
+	if f.net != nil {
+		return f.netDim
+	}
+	var res int
+	if f.HOG != nil {
+		res += f.HOG.Dim()
+	}
+	return res + f.Zones*f.Zones + 2*f.Projections
+}
+
+// Inputs computes the feature vector for a sample,
+// or returns the pixels if f is nil.
+func (f *FeatureExtractor) Inputs(s *Sample) []float64 {
+	if f == nil {
+		return s[:]
+	}
+	if f.net != nil {
+		return f.net.Output(s)
+	}
+	res := make([]float64, 0, f.Dim())
+	if f.HOG != nil {
+		res = append(res, f.HOG.Descriptor(s)...)
+	}
+	if f.Zones != 0 {
+		res = append(res, zoningFeatures(s, f.Zones)...)
+	}
+	if f.Projections != 0 {
+		res = append(res, projectionFeatures(s, f.Projections)...)
+	}
+	return res
+}
+
+// inputVectors computes the inputs for every sample.
+func (f *FeatureExtractor) inputVectors(data []*TrainingSample) []linalg.Vector {
+	res := make([]linalg.Vector, len(data))
+	parallelFor(len(data), func(i int) {
+		res[i] = f.Inputs(data[i].Sample)
+	})
+	return res
+}
+
+// Dim returns the length of the descriptors.
+func (h *HOG) Dim() int {
+	blocks := h.cells() - h.BlockSize + 1
+	return blocks * blocks * h.BlockSize * h.BlockSize * h.Bins
+}
+
+// Descriptor computes the HOG descriptor of a sample.
+func (h *HOG) Descriptor(s *Sample) []float64 {
+	cells := h.cells()
+	hist := make([]float64, cells*cells*h.Bins)
+	for y := 0; y < cells*h.CellSize; y++ {
+		for x := 0; x < cells*h.CellSize; x++ {
+			gx := hogPixel(s, x+1, y) - hogPixel(s, x-1, y)
+			gy := hogPixel(s, x, y+1) - hogPixel(s, x, y-1)
+			mag := math.Hypot(gx, gy)
+			if mag == 0 {
+				continue
+			}
+			// Split the vote between the two nearest
+			// orientation bins.
+			angle := math.Atan2(gy, gx)
+			if angle < 0 {
+				angle += math.Pi
+			}
+			pos := angle/math.Pi*float64(h.Bins) - 0.5
+			bin := int(math.Floor(pos))
+			frac := pos - float64(bin)
+			cell := (y/h.CellSize*cells + x/h.CellSize) * h.Bins
+			hist[cell+(bin+h.Bins)%h.Bins] += mag * (1 - frac)
+			hist[cell+(bin+1)%h.Bins] += mag * frac
+		}
+	}
+
+	blocks := cells - h.BlockSize + 1
+	res := make([]float64, 0, h.Dim())
+	for by := 0; by < blocks; by++ {
+		for bx := 0; bx < blocks; bx++ {
+			var block []float64
+			for cy := by; cy < by+h.BlockSize; cy++ {
+				for cx := bx; cx < bx+h.BlockSize; cx++ {
+					cell := (cy*cells + cx) * h.Bins
+					block = append(block, hist[cell:cell+h.Bins]...)
+				}
+			}
+			hogNormalize(block)
+			res = append(res, block...)
+		}
+	}
+	return res
+}
+
+func (h *HOG) cells() int {
+	return 28 / h.CellSize
+}
+
+func hogPixel(s *Sample, x, y int) float64 {
+	if x < 0 || x >= 28 || y < 0 || y >= 28 {
+		return 0
+	}
+	return s[y*28+x]
+}
+
+// hogNormalize applies L2-Hys normalization to a
+// block: it scales the block to unit length, clips
+// large values, and scales it to unit length again.
+func hogNormalize(block []float64) {
+	l2Normalize(block)
+	for i, x := range block {
+		block[i] = math.Min(x, hogClip)
+	}
+	l2Normalize(block)
+}
+
+func l2Normalize(v []float64) {
+	var sum float64
+	for _, x := range v {
+		sum += x * x
+	}
+	if sum == 0 {
+		return
+	}
+	norm := math.Sqrt(sum)
+	for i, x := range v {
+		v[i] = x / norm
+	}
+}
+
+// zoningFeatures computes the mean intensity within
+// each cell of a zones by zones grid.
+func zoningFeatures(s *Sample, zones int) []float64 {
+	res := make([]float64, zones*zones)
+	for zy := 0; zy < zones; zy++ {
+		y1, y2 := zy*28/zones, (zy+1)*28/zones
+		for zx := 0; zx < zones; zx++ {
+			x1, x2 := zx*28/zones, (zx+1)*28/zones
+			var sum float64
+			for y := y1; y < y2; y++ {
+				for x := x1; x < x2; x++ {
+					sum += s[y*28+x]
+				}
+			}
+			res[zy*zones+zx] = sum / float64((y2-y1)*(x2-x1))
+		}
+	}
+	return res
+}
+
+// projectionFeatures computes the mean intensity of
+// each of bins horizontal bands, followed by that of
+// each of bins vertical bands.
+func projectionFeatures(s *Sample, bins int) []float64 {
+	res := make([]float64, 2*bins)
+	for b := 0; b < bins; b++ {
+		start, end := b*28/bins, (b+1)*28/bins
+		var rows, cols float64
+		for i := start; i < end; i++ {
+			for j := 0; j < 28; j++ {
+				rows += s[i*28+j]
+				cols += s[j*28+i]
+			}
+		}
+		count := float64((end - start) * 28)
+		res[b] = rows / count
+		res[bins+b] = cols / count
+	}
+	return res
+}
@@ -1,10 +1,10 @@
 package mnistdemo
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"log"
-	"math"
 	"math/rand"
 	"strconv"
 	"time"
@@ -25,8 +25,21 @@ func init() {
 }
 
 // A Forest is a random forest.
+//
+// If Features is set, the trees split on its
+// features rather than on pixels.
 type Forest struct {
-	F []*archivedTree
+	F        []*archivedTree
+	Features *FeatureExtractor
+}
+
+// forestArchive is the serialized form of a Forest
+// with a FeatureExtractor.
+// Forests on pixels are serialized as a bare list of
+// trees.
+type forestArchive struct {
+	Features *FeatureExtractor
+	Trees    json.RawMessage
 }
 
 // DeserializeForest deserializes a Forest that was
@@ -36,18 +49,26 @@ func DeserializeForest(compressed []byte) (*Forest, error) {
 	if err != nil {
 		return nil, errors.New("failed to decompress tree: " + err.Error())
 	}
+	var features *FeatureExtractor
+	if trimmed := bytes.TrimSpace(d); len(trimmed) > 0 && trimmed[0] == '{' {
+		var archive forestArchive
+		if err := json.Unmarshal(d, &archive); err != nil {
+			return nil, err
+		}
+		d, features = archive.Trees, archive.Features
+	}
 	var archived []*archivedTree
 	if err := unmarshalTrees(d, &archived); err != nil {
 		return nil, err
 	}
-	return &Forest{F: archived}, nil
+	return &Forest{F: archived, Features: features}, nil
 }
 
 // Train trains the forest on the given training data.
 func (f *Forest) Train(data, validation []*TrainingSample) {
 	rand.Seed(time.Now().UnixNano())
-	samples := newForestSamples(data)
-	attrs := forestAttrs()
+	samples := newForestSamples(f.Features, data)
+	attrs := forestAttrs(f.Features.Dim())
 	log.Println("Building forest...")
 	forest := idtrees.BuildForest(forestTreeCount, samples, attrs, forestSampleSubset,
 		forestAttrSubset,
@@ -69,27 +90,33 @@ func (f *Forest) Train(data, validation []*TrainingSample) {
 	log.Printf("Validation score: %d/%d", correctCount, len(validation))
 }
 
+// TrainSoft trains the forest on labels drawn from
+// the target distributions, so that the trees' votes
+// match the targets in expectation.
+func (f *Forest) TrainSoft(data []*SoftSample, validation []*TrainingSample) {
+	gen := rand.New(rand.NewSource(time.Now().UnixNano()))
+	f.Train(drawnSamples(data, gen), validation)
+}
+
 // Classify returns the most likely class for the sample.
 func (f *Forest) Classify(s *Sample) int {
-	sums := map[string]float64{}
-	for _, t := range f.F {
-		res := t.Classify(s)
-		for key, val := range res {
-			sums[key] += val
-		}
-	}
+	scores := f.Scores(s)
+	return maxIndex(scores[:])
+}
 
-	maxClass := "0"
-	maxLikelihood := math.Inf(-1)
-	for class, likelihood := range sums {
-		if likelihood > maxLikelihood {
-			maxLikelihood = likelihood
-			maxClass = class
+// Scores sums the class probabilities predicted by
+// every tree.
+func (f *Forest) Scores(s *Sample) [10]float64 {
+	inputs := f.Features.Inputs(s)
+	var sums [10]float64
+	for _, t := range f.F {
+		for key, val := range t.Classify(inputs) {
+			if class, err := strconv.Atoi(key); err == nil && class >= 0 && class < 10 {
+				sums[class] += val
+			}
 		}
 	}
-
-	res, _ := strconv.Atoi(maxClass)
-	return res
+	return sums
 }
 
 // SerializerType returns Forest's unique type ID
@@ -104,11 +131,17 @@ func (f *Forest) Serialize() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if f.Features != nil {
+		data, err = json.Marshal(&forestArchive{Features: f.Features, Trees: data})
+		if err != nil {
+			return nil, err
+		}
+	}
 	return compress(data), nil
 }
 
-func forestAttrs() []idtrees.Attr {
-	res := make([]idtrees.Attr, 28*28)
+func forestAttrs(dim int) []idtrees.Attr {
+	res := make([]idtrees.Attr, dim)
 	for i := range res {
 		res[i] = i
 	}
@@ -116,23 +149,24 @@ func forestAttrs() []idtrees.Attr {
 }
 
 type forestSample struct {
-	T *TrainingSample
+	Inputs []float64
+	Label  int
 }
 
-func newForestSamples(ts []*TrainingSample) []idtrees.Sample {
+func newForestSamples(f *FeatureExtractor, ts []*TrainingSample) []idtrees.Sample {
 	res := make([]idtrees.Sample, len(ts))
-	for i, t := range ts {
-		res[i] = forestSample{T: t}
-	}
+	parallelFor(len(ts), func(i int) {
+		res[i] = forestSample{Inputs: f.Inputs(ts[i].Sample), Label: ts[i].Label}
+	})
 	return res
 }
 
 func (f forestSample) Attr(a idtrees.Attr) idtrees.Val {
-	return f.T.Sample[a.(int)]
+	return f.Inputs[a.(int)]
 }
 
 func (f forestSample) Class() idtrees.Class {
-	return f.T.Label
+	return f.Label
 }
 
 type archivedTree struct {
@@ -159,9 +193,11 @@ func archiveTree(t *idtrees.Tree) *archivedTree {
 	return res
 }
 
-func (a *archivedTree) Classify(s *Sample) map[string]float64 {
+// Classify follows the tree for a sample's pixels or
+// features.
+func (a *archivedTree) Classify(inputs []float64) map[string]float64 {
 	for a.Classification == nil {
-		p := s[a.Pixel]
+		p := inputs[a.Pixel]
 		if p > a.Threshold {
 			a = a.Greater
 		} else {
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/unixpickle/mnistdemo"
+	"github.com/unixpickle/serializer"
+)
+
+func main() {
+	var class, count int
+	var k float64
+	var seed int64
+	flag.IntVar(&class, "class", -1, "digit to generate (-1 for all)")
+	flag.IntVar(&count, "count", 8, "number of random samples per digit")
+	flag.Float64Var(&k, "k", 2, "standard deviations for the prototype images")
+	flag.Int64Var(&seed, "seed", time.Now().UnixNano(), "random seed")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <model_file> <output.png>\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Each row shows a digit's mean -k std, mean, and mean +k std,")
+		fmt.Fprintln(os.Stderr, "followed by random samples from the model.")
+		fmt.Fprintln(os.Stderr)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if class < -1 || class > 9 {
+		fmt.Fprintln(os.Stderr, "Class must be between -1 and 9:", class)
+		os.Exit(1)
+	}
+
+	data, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to read model:", err)
+		os.Exit(1)
+	}
+	model, err := serializer.DeserializeWithType(data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to deserialize model:", err)
+		os.Exit(1)
+	}
+	generator, ok := model.(mnistdemo.Generator)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Model type %T is not generative.\n", model)
+		os.Exit(1)
+	}
+	if bayes, ok := model.(*mnistdemo.Bayes); ok && bayes.Features != nil {
+		fmt.Fprintln(os.Stderr, "Bayes models on extracted features cannot draw images.")
+		os.Exit(1)
+	}
+
+	classes := []int{class}
+	if class < 0 {
+		classes = []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	}
+	gen := rand.New(rand.NewSource(seed))
+	var images []image.Image
+	for _, c := range classes {
+		images = append(images, generator.Prototype(c, -k).Image(),
+			generator.Prototype(c, 0).Image(), generator.Prototype(c, k).Image())
+		for i := 0; i < count; i++ {
+			images = append(images, generator.Generate(c, gen).Image())
+		}
+	}
+
+	f, err := os.Create(flag.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to create output:", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	if err := png.Encode(f, mnistdemo.ImageGrid(images, count+3)); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to encode image:", err)
+		os.Exit(1)
+	}
+}
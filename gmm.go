@@ -0,0 +1,376 @@
+package mnistdemo
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+)
+
+const (
+	gmmSerializerID = "github.com/unixpickle/mnistdemo.GMM"
+
+	gmmDefaultComponents = 5
+	gmmDefaultFeatures   = 40
+	gmmDefaultIterations = 50
+	gmmRidge             = 1e-3
+	gmmConvergence       = 1e-4
+)
+
+func init() {
+	serializer.RegisterTypedDeserializer(gmmSerializerID, DeserializeGMM)
+}
+
+// A GMM models each class as a mixture of Gaussians
+// in a reduced PCA space, fit with EM.
+//
+// Components is the number of Gaussians per class
+// (default 5), Features is the number of principal
+// components (default 40), and Iterations is the
+// maximum number of EM iterations (default 50).
+// If Full is set, each Gaussian has a full covariance
+// matrix; otherwise, it has a diagonal one.
+type GMM struct {
+	Components int
+	Features   int
+	Iterations int
+	Full       bool
+
+	PCA       *PCA
+	LogPriors [10]float64
+	Mixtures  [10]*GaussianMixture
+}
+
+// A GaussianMixture is a weighted sum of Gaussian
+// densities.
+//
+// Diagonal mixtures store the variances of each
+// component, while full mixtures store the Cholesky
+// factor of each component's covariance.
+type GaussianMixture struct {
+	LogWeights []float64
+	Means      []linalg.Vector
+	Variances  []linalg.Vector  `json:",omitempty"`
+	Factors    []*linalg.Matrix `json:",omitempty"`
+	LogDets    []float64
+}
+
+// DeserializeGMM deserializes a GMM that was
+// serialized with GMM.Serialize().
+func DeserializeGMM(d []byte) (*GMM, error) {
+	var res GMM
+	data, err := decompress(d)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Train fits a mixture to each class.
+func (g *GMM) Train(data, validation []*TrainingSample) {
+	log.Println("Computing principal components...")
+	features := g.Features
+	if features == 0 {
+		features = gmmDefaultFeatures
+	}
+	g.PCA = FitPCA(trainingVectors(data), &PCAConfig{Components: features})
+
+	var classData [10][]linalg.Vector
+	for _, x := range data {
+		classData[x.Label] = append(classData[x.Label], g.PCA.Transform(x.Sample[:]))
+	}
+	for class, vecs := range classData {
+		g.LogPriors[class] = logPrior(len(vecs), len(data))
+	}
+
+	log.Println("Fitting mixtures...")
+	parallelFor(10, func(class int) {
+		if len(classData[class]) == 0 {
+			return
+		}
+		g.Mixtures[class] = g.fitMixture(class, classData[class])
+	})
+
+	log.Println("Running cross validation...")
+	var correct int
+	for _, x := range validation {
+		if g.Classify(x.Sample) == x.Label {
+			correct++
+		}
+	}
+	log.Printf("Got %d/%d", correct, len(validation))
+}
+
+// Classify returns the class with the highest
+// log-likelihood plus log prior.
+func (g *GMM) Classify(s *Sample) int {
+	scores := g.Scores(s)
+	return maxIndex(scores[:])
+}
+
+// Scores computes the log-likelihood plus log prior
+// of each class.
+func (g *GMM) Scores(s *Sample) [10]float64 {
+	features := g.PCA.Transform(s[:])
+	var scores [10]float64
+	for class, mixture := range g.Mixtures {
+		if mixture == nil {
+			scores[class] = math.Inf(-1)
+			continue
+		}
+		scores[class] = g.LogPriors[class] + mixture.LogLikelihood(features)
+	}
+	return scores
+}
+
+// SerializerType returns the unique ID used to
+// serialize GMMs.
+func (g *GMM) SerializerType() string {
+	return gmmSerializerID
+}
+
+// Serialize serializes the model's parameters.
+func (g *GMM) Serialize() ([]byte, error) {
+	data, err := json.Marshal(g)
+	if err != nil {
+		return nil, err
+	}
+	return compress(data), nil
+}
+
+// fitMixture runs EM on one class, starting from a
+// k-means clustering.
+// Components which lose all their responsibility are
+// dropped from the result.
+func (g *GMM) fitMixture(class int, data []linalg.Vector) *GaussianMixture {
+	count := g.Components
+	if count == 0 {
+		count = gmmDefaultComponents
+	}
+	if count > len(data) {
+		count = len(data)
+	}
+	_, assignments := kMeans(data, count)
+	resp := make([][]float64, len(data))
+	for i, idx := range assignments {
+		resp[i] = make([]float64, count)
+		resp[i][idx] = 1
+	}
+
+	maxIters := g.Iterations
+	if maxIters == 0 {
+		maxIters = gmmDefaultIterations
+	}
+	mixture := &GaussianMixture{}
+	lastLikelihood := math.Inf(-1)
+	for iter := 0; iter < maxIters; iter++ {
+		mixture.maximize(data, resp, g.Full)
+		likelihood := mixture.expect(data, resp)
+		if likelihood-lastLikelihood < gmmConvergence {
+			log.Printf("Class %d: converged after %d iterations (log-likelihood %f)",
+				class, iter+1, likelihood)
+			mixture.prune()
+			return mixture
+		}
+		lastLikelihood = likelihood
+	}
+	log.Printf("Class %d: log-likelihood %f", class, lastLikelihood)
+	mixture.prune()
+	return mixture
+}
+
+// prune removes components with zero weight, whose
+// log weights JSON cannot encode.
+func (g *GaussianMixture) prune() {
+	var keep []int
+	for k, logWeight := range g.LogWeights {
+		if !math.IsInf(logWeight, -1) {
+			keep = append(keep, k)
+		}
+	}
+	if len(keep) == len(g.LogWeights) {
+		return
+	}
+	log.Printf("Dropping %d empty components.", len(g.LogWeights)-len(keep))
+	res := &GaussianMixture{}
+	for _, k := range keep {
+		res.LogWeights = append(res.LogWeights, g.LogWeights[k])
+		res.Means = append(res.Means, g.Means[k])
+		res.LogDets = append(res.LogDets, g.LogDets[k])
+		if g.Factors != nil {
+			res.Factors = append(res.Factors, g.Factors[k])
+		} else {
+			res.Variances = append(res.Variances, g.Variances[k])
+		}
+	}
+	*g = *res
+}
+
+// LogLikelihood computes the log density of the
+// mixture at a point.
+func (g *GaussianMixture) LogLikelihood(x linalg.Vector) float64 {
+	logProbs := make([]float64, len(g.Means))
+	g.componentLogProbs(x, logProbs)
+	return logSumExp(logProbs)
+}
+
+// componentLogProbs computes the log of each
+// component's weighted density at a point.
+func (g *GaussianMixture) componentLogProbs(x linalg.Vector, out []float64) {
+	diff := make([]float64, len(x))
+	logNorm := float64(len(x)) * math.Log(2*math.Pi)
+	for k, mean := range g.Means {
+		for j, v := range x {
+			diff[j] = v - mean[j]
+		}
+		var mahalanobis float64
+		if g.Factors != nil {
+			mahalanobis = choleskyMahalanobis(g.Factors[k], diff)
+		} else {
+			for j, d := range diff {
+				mahalanobis += d * d / g.Variances[k][j]
+			}
+		}
+		out[k] = g.LogWeights[k] - 0.5*(logNorm+g.LogDets[k]+mahalanobis)
+	}
+}
+
+// expect computes the responsibilities of each
+// component for each point, and returns the mean
+// log-likelihood of the points.
+func (g *GaussianMixture) expect(data []linalg.Vector, resp [][]float64) float64 {
+	likelihoods := make([]float64, len(data))
+	parallelFor(len(data), func(i int) {
+		g.componentLogProbs(data[i], resp[i])
+		likelihoods[i] = logSumExp(resp[i])
+		for k, logProb := range resp[i] {
+			resp[i][k] = math.Exp(logProb - likelihoods[i])
+		}
+	})
+	var sum float64
+	for _, l := range likelihoods {
+		sum += l
+	}
+	return sum / float64(len(data))
+}
+
+// maximize sets the parameters from the
+// responsibilities.
+// Components without any responsibility keep their
+// old means and covariances and get zero weight, so
+// they stay empty until they are pruned.
+func (g *GaussianMixture) maximize(data []linalg.Vector, resp [][]float64, full bool) {
+	count := len(resp[0])
+	dim := len(data[0])
+	if g.Means == nil {
+		g.LogWeights = make([]float64, count)
+		g.Means = make([]linalg.Vector, count)
+		g.LogDets = make([]float64, count)
+		if full {
+			g.Factors = make([]*linalg.Matrix, count)
+		} else {
+			g.Variances = make([]linalg.Vector, count)
+		}
+	}
+	parallelFor(count, func(k int) {
+		var weight float64
+		mean := make(linalg.Vector, dim)
+		for i, x := range data {
+			r := resp[i][k]
+			weight += r
+			for j, v := range x {
+				mean[j] += r * v
+			}
+		}
+		g.LogWeights[k] = math.Log(weight / float64(len(data)))
+		if weight == 0 {
+			if g.Means[k] == nil {
+				g.Means[k] = data[0]
+				g.setCovariance(k, nil, full)
+			}
+			return
+		}
+		for j := range mean {
+			mean[j] /= weight
+		}
+		g.Means[k] = mean
+
+		cov := linalg.NewMatrix(dim, dim)
+		diff := make([]float64, dim)
+		for i, x := range data {
+			r := resp[i][k]
+			if r == 0 {
+				continue
+			}
+			for j, v := range x {
+				diff[j] = v - mean[j]
+			}
+			for j, dj := range diff {
+				if !full {
+					cov.Data[j*dim+j] += r * dj * dj
+					continue
+				}
+				row := cov.Data[j*dim : (j+1)*dim]
+				for l, dl := range diff[:j+1] {
+					row[l] += r * dj * dl
+				}
+			}
+		}
+		for j := 0; j < dim; j++ {
+			for l := 0; l <= j; l++ {
+				cov.Data[j*dim+l] /= weight
+				cov.Data[l*dim+j] = cov.Data[j*dim+l]
+			}
+		}
+		g.setCovariance(k, cov, full)
+	})
+}
+
+// setCovariance stores a component's covariance,
+// adding a small ridge to keep it well conditioned.
+// A nil covariance is treated as zero.
+func (g *GaussianMixture) setCovariance(k int, cov *linalg.Matrix, full bool) {
+	dim := len(g.Means[k])
+	if cov == nil {
+		cov = linalg.NewMatrix(dim, dim)
+	}
+	for j := 0; j < dim; j++ {
+		cov.Data[j*dim+j] += gmmRidge
+	}
+	if !full {
+		variances := make(linalg.Vector, dim)
+		var logDet float64
+		for j := range variances {
+			variances[j] = cov.Data[j*dim+j]
+			logDet += math.Log(variances[j])
+		}
+		g.Variances[k] = variances
+		g.LogDets[k] = logDet
+		return
+	}
+	factor, err := cholesky(cov)
+	if err != nil {
+		panic("mixture covariance: " + err.Error())
+	}
+	g.Factors[k] = factor
+	g.LogDets[k] = choleskyLogDet(factor)
+}
+
+// logSumExp computes log(sum(exp(v))) without
+// overflow.
+func logSumExp(v []float64) float64 {
+	max := maxValue(v)
+	if math.IsInf(max, -1) {
+		return max
+	}
+	var sum float64
+	for _, x := range v {
+		sum += math.Exp(x - max)
+	}
+	return max + math.Log(sum)
+}
@@ -0,0 +1,313 @@
+package mnistdemo
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+
+	"github.com/unixpickle/serializer"
+)
+
+const (
+	hierarchySerializerID = "github.com/unixpickle/mnistdemo.Hierarchy"
+
+	hierarchyDefaultFirst      = "softmax"
+	hierarchyDefaultSpecialist = "svm"
+	hierarchyDefaultMaxGroup   = 3
+	hierarchyMinConfusionRate  = 0.002
+	hierarchyHoldout           = 0.1
+)
+
+func init() {
+	serializer.RegisterTypedDeserializer(hierarchySerializerID, DeserializeHierarchy)
+}
+
+// A Hierarchy is a two-stage classifier.
+// A general model makes a first guess, and whenever
+// it guesses a member of a group of easily confused
+// digits, a specialist trained only on that group
+// decides between them.
+//
+// First and Specialist name the models in
+// Classifiers, defaulting to "softmax" and "svm".
+// The groups are found by joining the pairs of
+// digits that the first model confuses most often on
+// a tenth of the training data which it was not
+// trained on, up to MaxGroup (default 3) digits per
+// group.
+// The first model is then retrained on all of the
+// training data.
+type Hierarchy struct {
+	First      string
+	Specialist string
+	MaxGroup   int
+
+	Groups      [][]int
+	FirstModel  Classifier
+	Specialists []Classifier
+}
+
+// hierarchyArchive is the serialized form of a
+// Hierarchy, with each model serialized with its
+// type.
+type hierarchyArchive struct {
+	First       string
+	Specialist  string
+	MaxGroup    int
+	Groups      [][]int
+	FirstModel  []byte
+	Specialists [][]byte
+}
+
+// DeserializeHierarchy deserializes a Hierarchy that
+// was serialized with Hierarchy.Serialize().
+func DeserializeHierarchy(d []byte) (*Hierarchy, error) {
+	data, err := decompress(d)
+	if err != nil {
+		return nil, err
+	}
+	var archive hierarchyArchive
+	if err := json.Unmarshal(data, &archive); err != nil {
+		return nil, err
+	}
+	res := &Hierarchy{
+		First:      archive.First,
+		Specialist: archive.Specialist,
+		MaxGroup:   archive.MaxGroup,
+		Groups:     archive.Groups,
+	}
+	res.FirstModel, err = deserializeClassifier(archive.FirstModel)
+	if err != nil {
+		return nil, err
+	}
+	for _, modelData := range archive.Specialists {
+		model, err := deserializeClassifier(modelData)
+		if err != nil {
+			return nil, err
+		}
+		res.Specialists = append(res.Specialists, model)
+	}
+	return res, nil
+}
+
+// Train trains the first stage, finds the confusable
+// groups, and trains a specialist for each group.
+func (h *Hierarchy) Train(data, validation []*TrainingSample) {
+	fitData, heldOut := holdoutSplit(data, hierarchyHoldout)
+	first := constructClassifier(h.First, hierarchyDefaultFirst)
+	log.Println("Training first stage...")
+	first.Train(fitData, validation)
+
+	confusion := Confusion(first, heldOut)
+	log.Printf("First stage confusion on held-out data:\n%s", confusion)
+	maxGroup := h.MaxGroup
+	if maxGroup == 0 {
+		maxGroup = hierarchyDefaultMaxGroup
+	}
+	minCount := maxInt(1, int(hierarchyMinConfusionRate*float64(len(heldOut))))
+	h.Groups = confusableGroups(confusion, maxGroup, minCount)
+
+	log.Println("Retraining first stage on all data...")
+	first = constructClassifier(h.First, hierarchyDefaultFirst)
+	first.Train(data, validation)
+	h.FirstModel = first
+
+	h.Specialists = nil
+	for _, group := range h.Groups {
+		log.Printf("Training specialist for %v...", group)
+		specialist := constructClassifier(h.Specialist, hierarchyDefaultSpecialist)
+		specialist.Train(samplesWithLabels(data, group),
+			samplesWithLabels(validation, group))
+		h.Specialists = append(h.Specialists, specialist)
+	}
+
+	log.Println("Running cross validation...")
+	var correct int
+	for _, x := range validation {
+		if h.Classify(x.Sample) == x.Label {
+			correct++
+		}
+	}
+	log.Printf("Got %d/%d", correct, len(validation))
+}
+
+// Classify runs the first stage and, if its guess is
+// in a group, lets that group's specialist decide.
+// Specialist guesses outside of the group are
+// ignored.
+func (h *Hierarchy) Classify(s *Sample) int {
+	guess := h.FirstModel.Classify(s)
+	for i, group := range h.Groups {
+		if !containsInt(group, guess) {
+			continue
+		}
+		if refined := h.Specialists[i].Classify(s); containsInt(group, refined) {
+			return refined
+		}
+		break
+	}
+	return guess
+}
+
+// SerializerType returns the unique ID used to
+// serialize Hierarchies.
+func (h *Hierarchy) SerializerType() string {
+	return hierarchySerializerID
+}
+
+// Serialize serializes the groups along with every
+// model.
+func (h *Hierarchy) Serialize() ([]byte, error) {
+	archive := &hierarchyArchive{
+		First:      h.First,
+		Specialist: h.Specialist,
+		MaxGroup:   h.MaxGroup,
+		Groups:     h.Groups,
+	}
+	var err error
+	archive.FirstModel, err = serializer.SerializeWithType(h.FirstModel)
+	if err != nil {
+		return nil, err
+	}
+	for _, model := range h.Specialists {
+		modelData, err := serializer.SerializeWithType(model)
+		if err != nil {
+			return nil, err
+		}
+		archive.Specialists = append(archive.Specialists, modelData)
+	}
+	data, err := json.Marshal(archive)
+	if err != nil {
+		return nil, err
+	}
+	return compress(data), nil
+}
+
+// confusableGroups joins digits into groups, starting
+// with the most confused pairs and ignoring pairs
+// confused fewer than minCount times in total.
+func confusableGroups(confusion *ConfusionMatrix, maxGroup, minCount int) [][]int {
+	var pairs hierarchyPairs
+	for a := 0; a < 10; a++ {
+		for b := a + 1; b < 10; b++ {
+			count := confusion[a][b] + confusion[b][a]
+			if count >= minCount {
+				pairs = append(pairs, hierarchyPair{a, b, count})
+			}
+		}
+	}
+	sort.Stable(pairs)
+
+	var groupOf [10]int
+	members := map[int][]int{}
+	for i := range groupOf {
+		groupOf[i] = i
+		members[i] = []int{i}
+	}
+	for _, p := range pairs {
+		ga, gb := groupOf[p.A], groupOf[p.B]
+		if ga == gb || len(members[ga])+len(members[gb]) > maxGroup {
+			continue
+		}
+		log.Printf("Joining %v and %v (%d confusions)", members[ga], members[gb], p.Count)
+		for _, digit := range members[gb] {
+			groupOf[digit] = ga
+		}
+		members[ga] = append(members[ga], members[gb]...)
+		delete(members, gb)
+	}
+
+	var res [][]int
+	for digit := 0; digit < 10; digit++ {
+		group := members[digit]
+		if len(group) > 1 {
+			sort.Ints(group)
+			res = append(res, group)
+		}
+	}
+	return res
+}
+
+type hierarchyPair struct {
+	A, B  int
+	Count int
+}
+
+// hierarchyPairs sorts pairs from most to least
+// confused.
+type hierarchyPairs []hierarchyPair
+
+func (h hierarchyPairs) Len() int {
+	return len(h)
+}
+
+func (h hierarchyPairs) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h hierarchyPairs) Less(i, j int) bool {
+	return h[i].Count > h[j].Count
+}
+
+// constructClassifier creates a classifier from
+// Classifiers, using defaultName if name is empty.
+func constructClassifier(name, defaultName string) Classifier {
+	if name == "" {
+		name = defaultName
+	}
+	desc, ok := Classifiers[name]
+	if !ok {
+		panic("unknown classifier: " + name)
+	}
+	return desc.Construct()
+}
+
+// deserializeClassifier deserializes a Classifier
+// that was serialized with its type.
+func deserializeClassifier(data []byte) (Classifier, error) {
+	obj, err := serializer.DeserializeWithType(data)
+	if err != nil {
+		return nil, err
+	}
+	res, ok := obj.(Classifier)
+	if !ok {
+		return nil, fmt.Errorf("not a classifier: %T", obj)
+	}
+	return res, nil
+}
+
+// holdoutSplit randomly splits off a fraction of the
+// data for tuning, so that validation data is only
+// used for reporting.
+func holdoutSplit(data []*TrainingSample, fraction float64) (fit, heldOut []*TrainingSample) {
+	count := int(fraction * float64(len(data)))
+	for i, j := range rand.Perm(len(data)) {
+		if i < count {
+			heldOut = append(heldOut, data[j])
+		} else {
+			fit = append(fit, data[j])
+		}
+	}
+	return
+}
+
+func samplesWithLabels(data []*TrainingSample, labels []int) []*TrainingSample {
+	var res []*TrainingSample
+	for _, x := range data {
+		if containsInt(labels, x.Label) {
+			res = append(res, x)
+		}
+	}
+	return res
+}
+
+func containsInt(list []int, x int) bool {
+	for _, y := range list {
+		if x == y {
+			return true
+		}
+	}
+	return false
+}
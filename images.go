@@ -0,0 +1,77 @@
+package mnistdemo
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// An ImageRenderer is a model whose learned
+// parameters can be visualized as images, such as
+// per-class templates or prototypes.
+type ImageRenderer interface {
+	RenderImages() []image.Image
+}
+
+// Image converts the sample to a grayscale image,
+// mapping an intensity of 1 to black.
+func (s *Sample) Image() *image.Gray {
+	return vectorImage(s[:], 0, 1)
+}
+
+// clip clamps every pixel to the range [0, 1].
+func (s *Sample) clip() {
+	for i, x := range s {
+		s[i] = math.Max(0, math.Min(1, x))
+	}
+}
+
+func (s *Sample) sum() float64 {
+	var res float64
+	for _, x := range s {
+		res += x
+	}
+	return res
+}
+
+// ImageGrid arranges equally-sized images into a
+// grid with the given number of columns, separated
+// by one pixel of padding.
+func ImageGrid(images []image.Image, cols int) image.Image {
+	if len(images) == 0 {
+		return image.NewGray(image.Rect(0, 0, 0, 0))
+	}
+	size := images[0].Bounds().Size()
+	rows := (len(images) + cols - 1) / cols
+	res := image.NewGray(image.Rect(0, 0, cols*(size.X+1)+1, rows*(size.Y+1)+1))
+	draw.Draw(res, res.Bounds(), image.NewUniform(color.Gray{Y: 0x80}),
+		image.Point{}, draw.Src)
+	for i, img := range images {
+		x := (i%cols)*(size.X+1) + 1
+		y := (i/cols)*(size.Y+1) + 1
+		rect := image.Rect(x, y, x+size.X, y+size.Y)
+		draw.Draw(res, rect, img, img.Bounds().Min, draw.Src)
+	}
+	return res
+}
+
+// vectorImage renders a 28x28 vector as a grayscale
+// image, mapping min to white and max to black.
+func vectorImage(v []float64, min, max float64) *image.Gray {
+	res := image.NewGray(image.Rect(0, 0, 28, 28))
+	for i, x := range v {
+		frac := (x - min) / (max - min)
+		frac = math.Max(0, math.Min(1, frac))
+		res.Pix[i] = uint8(255 - frac*255 + 0.5)
+	}
+	return res
+}
+
+func maxValue(v []float64) float64 {
+	res := math.Inf(-1)
+	for _, x := range v {
+		res = math.Max(res, x)
+	}
+	return res
+}
@@ -0,0 +1,374 @@
+package mnistdemo
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/weakai/neuralnet"
+	"github.com/unixpickle/weakai/rbf"
+)
+
+const (
+	inferenceCheckCount = 3
+	inferenceTolerance  = 1e-6
+)
+
+// An inferenceStage is one forward-only step of an
+// inferenceEngine.
+type inferenceStage interface {
+	OutputSize() int
+	Forward(in, out []float64)
+}
+
+// An inferenceEngine evaluates a trained network
+// without building an autodiff graph.
+//
+// Stages read parameters straight from the network's
+// variables, so in-place training updates are seen
+// without recompiling.
+// Intermediate results are written to pooled scratch
+// buffers, so evaluation does not allocate.
+type inferenceEngine struct {
+	stages  []inferenceStage
+	scratch sync.Pool
+}
+
+func newInferenceEngine(inSize int, stages []inferenceStage) *inferenceEngine {
+	maxSize := inSize
+	for _, stage := range stages {
+		if stage.OutputSize() > maxSize {
+			maxSize = stage.OutputSize()
+		}
+	}
+	res := &inferenceEngine{stages: stages}
+	res.scratch.New = func() interface{} {
+		return &[2][]float64{make([]float64, maxSize), make([]float64, maxSize)}
+	}
+	return res
+}
+
+// Apply runs the network on an input and calls f
+// with the output.
+// The output slice is only valid during the call.
+func (e *inferenceEngine) Apply(in []float64, f func(out []float64)) {
+	buffers := e.scratch.Get().(*[2][]float64)
+	cur := in
+	for i, stage := range e.stages {
+		next := buffers[i%2][:stage.OutputSize()]
+		stage.Forward(cur, next)
+		cur = next
+	}
+	f(cur)
+	e.scratch.Put(buffers)
+}
+
+// Classify returns the index of the largest output.
+func (e *inferenceEngine) Classify(in []float64) int {
+	var res int
+	e.Apply(in, func(out []float64) {
+		for i, x := range out {
+			if x > out[res] {
+				res = i
+			}
+		}
+	})
+	return res
+}
+
+// verify checks that the engine agrees with the
+// autodiff implementation of a network on random
+// inputs.
+func (e *inferenceEngine) verify(inSize int, f autofunc.Func) error {
+	for i := 0; i < inferenceCheckCount; i++ {
+		in := make(linalg.Vector, inSize)
+		for j := range in {
+			in[j] = rand.Float64()
+		}
+		expected := f.Apply(&autofunc.Variable{Vector: in}).Output()
+		var err error
+		e.Apply(in, func(actual []float64) {
+			if len(actual) != len(expected) {
+				err = fmt.Errorf("output size %d (expected %d)", len(actual),
+					len(expected))
+				return
+			}
+			for j, x := range expected {
+				if math.Abs(x-actual[j]) > inferenceTolerance*math.Max(1, math.Abs(x)) {
+					err = fmt.Errorf("output %d is %f (expected %f)", j, actual[j], x)
+					return
+				}
+			}
+		})
+		if err != nil {
+			return errors.New("compiled network mismatch: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// compileNetwork converts a neural network into an
+// inferenceEngine and verifies the result.
+func compileNetwork(net neuralnet.Network, inSize int) (*inferenceEngine, error) {
+	var stages []inferenceStage
+	size := inSize
+	for _, layer := range net {
+		var stage inferenceStage
+		switch layer := layer.(type) {
+		case *neuralnet.ConvLayer:
+			if layer.Filters == nil || layer.Biases == nil {
+				return nil, errors.New("conv layer is not initialized")
+			}
+			stage = &convStage{Layer: layer}
+		case *neuralnet.MaxPoolingLayer:
+			stage = &maxPoolStage{Layer: layer}
+		case *neuralnet.DenseLayer:
+			if layer.Weights == nil || layer.Biases == nil {
+				return nil, errors.New("dense layer is not initialized")
+			}
+			stage = &denseStage{Layer: layer}
+		case *neuralnet.Sigmoid:
+			stage = sigmoidStage(size)
+		case *neuralnet.LogSoftmaxLayer:
+			stage = logSoftmaxStage(size)
+		default:
+			return nil, fmt.Errorf("unsupported layer: %T", layer)
+		}
+		stages = append(stages, stage)
+		size = stage.OutputSize()
+	}
+	engine := newInferenceEngine(inSize, stages)
+	if err := engine.verify(inSize, net); err != nil {
+		return nil, err
+	}
+	return engine, nil
+}
+
+// compileRBF converts an RBF network into an
+// inferenceEngine and verifies the result.
+func compileRBF(net *rbf.Network, inSize int) (*inferenceEngine, error) {
+	if net.DistLayer == nil || net.ScaleLayer == nil || net.ExpLayer == nil ||
+		net.OutLayer == nil {
+		return nil, errors.New("incomplete RBF network")
+	}
+	centers := net.DistLayer.Parameters()[0].Vector
+	dist := &rbfDistStage{Centers: centers, InSize: inSize}
+	stages := []inferenceStage{
+		dist,
+		&rbfScaleStage{
+			Scales: net.ScaleLayer.Parameters()[0].Vector,
+			Size:   dist.OutputSize(),
+		},
+		&rbfExpStage{Normalize: net.ExpLayer.Normalize, Size: dist.OutputSize()},
+		&denseStage{Layer: net.OutLayer},
+	}
+	engine := newInferenceEngine(inSize, stages)
+	if err := engine.verify(inSize, net); err != nil {
+		return nil, err
+	}
+	return engine, nil
+}
+
+// convStage evaluates a convolutional layer.
+// Tensors are stored with depth varying fastest,
+// then x, then y.
+type convStage struct {
+	Layer *neuralnet.ConvLayer
+}
+
+func (c *convStage) OutputSize() int {
+	return c.Layer.OutputWidth() * c.Layer.OutputHeight() * c.Layer.FilterCount
+}
+
+func (c *convStage) Forward(in, out []float64) {
+	l := c.Layer
+	outWidth, outHeight := l.OutputWidth(), l.OutputHeight()
+	biases := l.Biases.Vector
+	for y := 0; y < outHeight; y++ {
+		for x := 0; x < outWidth; x++ {
+			outIdx := (y*outWidth + x) * l.FilterCount
+			for f, filter := range l.Filters {
+				sum := biases[f]
+				for fy := 0; fy < l.FilterHeight; fy++ {
+					inY := y*l.Stride + fy
+					for fx := 0; fx < l.FilterWidth; fx++ {
+						inX := x*l.Stride + fx
+						inIdx := (inY*l.InputWidth + inX) * l.InputDepth
+						filterIdx := (fy*l.FilterWidth + fx) * l.InputDepth
+						for z := 0; z < l.InputDepth; z++ {
+							sum += in[inIdx+z] * filter.Data[filterIdx+z]
+						}
+					}
+				}
+				out[outIdx+f] = sum
+			}
+		}
+	}
+}
+
+// maxPoolStage evaluates a max-pooling layer,
+// including partial pools at the right and bottom
+// edges.
+type maxPoolStage struct {
+	Layer *neuralnet.MaxPoolingLayer
+}
+
+func (m *maxPoolStage) OutputSize() int {
+	return m.Layer.OutputWidth() * m.Layer.OutputHeight() * m.Layer.InputDepth
+}
+
+func (m *maxPoolStage) Forward(in, out []float64) {
+	l := m.Layer
+	outWidth, outHeight := l.OutputWidth(), l.OutputHeight()
+	for y := 0; y < outHeight; y++ {
+		for x := 0; x < outWidth; x++ {
+			for z := 0; z < l.InputDepth; z++ {
+				max := math.Inf(-1)
+				for py := y * l.YSpan; py < (y+1)*l.YSpan && py < l.InputHeight; py++ {
+					for px := x * l.XSpan; px < (x+1)*l.XSpan && px < l.InputWidth; px++ {
+						max = math.Max(max, in[(py*l.InputWidth+px)*l.InputDepth+z])
+					}
+				}
+				out[(y*outWidth+x)*l.InputDepth+z] = max
+			}
+		}
+	}
+}
+
+// denseStage evaluates a fully-connected layer whose
+// weights are stored row by row.
+type denseStage struct {
+	Layer *neuralnet.DenseLayer
+}
+
+func (d *denseStage) OutputSize() int {
+	return d.Layer.OutputCount
+}
+
+func (d *denseStage) Forward(in, out []float64) {
+	weights := d.Layer.Weights.Data.Vector
+	biases := d.Layer.Biases.Var.Vector
+	inCount := d.Layer.InputCount
+	for i := range out {
+		row := weights[i*inCount : (i+1)*inCount]
+		sum := biases[i]
+		for j, w := range row {
+			sum += w * in[j]
+		}
+		out[i] = sum
+	}
+}
+
+type sigmoidStage int
+
+func (s sigmoidStage) OutputSize() int {
+	return int(s)
+}
+
+func (s sigmoidStage) Forward(in, out []float64) {
+	for i, x := range in {
+		out[i] = 1 / (1 + math.Exp(-x))
+	}
+}
+
+type logSoftmaxStage int
+
+func (l logSoftmaxStage) OutputSize() int {
+	return int(l)
+}
+
+func (l logSoftmaxStage) Forward(in, out []float64) {
+	max := math.Inf(-1)
+	for _, x := range in {
+		max = math.Max(max, x)
+	}
+	var sum float64
+	for _, x := range in {
+		sum += math.Exp(x - max)
+	}
+	logSum := max + math.Log(sum)
+	for i, x := range in {
+		out[i] = x - logSum
+	}
+}
+
+// rbfDistStage computes squared distances from the
+// input to every center.
+type rbfDistStage struct {
+	Centers []float64
+	InSize  int
+}
+
+func (r *rbfDistStage) OutputSize() int {
+	return len(r.Centers) / r.InSize
+}
+
+func (r *rbfDistStage) Forward(in, out []float64) {
+	for i := range out {
+		center := r.Centers[i*r.InSize : (i+1)*r.InSize]
+		var sum float64
+		for j, c := range center {
+			d := in[j] - c
+			sum += d * d
+		}
+		out[i] = sum
+	}
+}
+
+// rbfScaleStage multiplies each distance by its
+// center's scale, or by one shared scale.
+type rbfScaleStage struct {
+	Scales []float64
+	Size   int
+}
+
+func (r *rbfScaleStage) OutputSize() int {
+	return r.Size
+}
+
+func (r *rbfScaleStage) Forward(in, out []float64) {
+	for i, x := range in {
+		if len(r.Scales) == 1 {
+			out[i] = x * r.Scales[0]
+		} else {
+			out[i] = x * r.Scales[i]
+		}
+	}
+}
+
+// rbfExpStage computes exp(-x) for each scaled
+// distance, optionally normalizing the results to
+// sum to one.
+type rbfExpStage struct {
+	Normalize bool
+	Size      int
+}
+
+func (r *rbfExpStage) OutputSize() int {
+	return r.Size
+}
+
+func (r *rbfExpStage) Forward(in, out []float64) {
+	if !r.Normalize {
+		for i, x := range in {
+			out[i] = math.Exp(-x)
+		}
+		return
+	}
+	min := math.Inf(1)
+	for _, x := range in {
+		min = math.Min(min, x)
+	}
+	var sum float64
+	for i, x := range in {
+		out[i] = math.Exp(min - x)
+		sum += out[i]
+	}
+	for i := range out {
+		out[i] /= sum
+	}
+}
@@ -0,0 +1,104 @@
+package mnistdemo
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/weakai/neuralnet"
+	"github.com/unixpickle/weakai/rbf"
+)
+
+const (
+	inferenceTestInputs    = 10
+	inferenceTestTolerance = 1e-9
+)
+
+func TestInferenceNeuralNet(t *testing.T) {
+	nets := map[string]*NeuralNet{
+		"full":  NewNeuralNet(),
+		"small": NewSmallNeuralNet(),
+	}
+	for name, net := range nets {
+		engine, err := compileNetwork(net.Net, 28*28)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		checkInference(t, name, engine, net.Net)
+	}
+}
+
+func TestInferenceTruncated(t *testing.T) {
+	net := NewNeuralNet()
+	for _, layer := range []string{NeuralNetLayerPool, NeuralNetLayerHidden} {
+		truncated, err := net.Truncate(layer)
+		if err != nil {
+			t.Errorf("%s: %s", layer, err)
+			continue
+		}
+		engine, err := compileNetwork(truncated.Net, 28*28)
+		if err != nil {
+			t.Errorf("%s: %s", layer, err)
+			continue
+		}
+		checkInference(t, layer, engine, truncated.Net)
+	}
+}
+
+func TestInferenceRBF(t *testing.T) {
+	const centers = 20
+	gen := rand.New(rand.NewSource(1))
+	var data []*TrainingSample
+	for i := 0; i < 50; i++ {
+		s := new(Sample)
+		for j := range s {
+			s[j] = gen.Float64()
+		}
+		data = append(data, &TrainingSample{Sample: s, Label: i % 10})
+	}
+	scales := map[string]*rbf.ScaleLayer{
+		"shared":     rbf.NewScaleLayerShared(rbfNetSharedScale),
+		"per-center": rbf.NewScaleLayer(centers, rbfNetSharedScale),
+	}
+	for name, scale := range scales {
+		net := &rbf.Network{
+			DistLayer:  rbf.NewDistLayerSamples(28*28, centers, neuralnetSampleSet(data)),
+			ScaleLayer: scale,
+			ExpLayer:   &rbf.ExpLayer{Normalize: true},
+			OutLayer:   &neuralnet.DenseLayer{InputCount: centers, OutputCount: 10},
+		}
+		net.OutLayer.Randomize()
+		engine, err := compileRBF(net, 28*28)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		checkInference(t, name, engine, net)
+	}
+}
+
+// checkInference compares an engine with the autodiff
+// implementation of a network on random inputs.
+func checkInference(t *testing.T, name string, engine *inferenceEngine, f autofunc.Func) {
+	gen := rand.New(rand.NewSource(1))
+	for i := 0; i < inferenceTestInputs; i++ {
+		in := make(linalg.Vector, 28*28)
+		for j := range in {
+			in[j] = gen.Float64()
+		}
+		expected := f.Apply(&autofunc.Variable{Vector: in}).Output()
+		engine.Apply(in, func(actual []float64) {
+			if len(actual) != len(expected) {
+				t.Fatalf("%s: output size %d (expected %d)", name, len(actual), len(expected))
+			}
+			for j, x := range expected {
+				if math.Abs(x-actual[j]) > inferenceTestTolerance*math.Max(1, math.Abs(x)) {
+					t.Fatalf("%s: output %d is %v (expected %v)", name, j, actual[j], x)
+				}
+			}
+		})
+	}
+}
@@ -1,6 +1,10 @@
 package mnistdemo
 
-import "github.com/unixpickle/serializer"
+import (
+	"math/rand"
+
+	"github.com/unixpickle/serializer"
+)
 
 // Sample is a 28x28 image.
 // Pixels in the image are 1 if they're black and
@@ -23,6 +27,70 @@ type Classifier interface {
 	Classify(s *Sample) int
 }
 
+// A Scorer is a Classifier which can score every
+// class, with higher scores for more likely classes.
+// Scores are only comparable within a single model.
+type Scorer interface {
+	Classifier
+
+	Scores(s *Sample) [10]float64
+}
+
+// A Transformer preprocesses samples before they are
+// classified.
+// Fit is called on the training data before any
+// samples are transformed.
+//
+// Transformers map images to images, so feature
+// vectors such as HOG descriptors cannot be
+// Transformers; a FeatureExtractor computes those
+// instead.
+type Transformer interface {
+	serializer.Serializer
+
+	Fit(data []*TrainingSample)
+	Transform(s *Sample) *Sample
+}
+
+// A SoftSample is an image sample with a target
+// probability for each digit, such as the output of
+// a teacher model.
+type SoftSample struct {
+	Sample *Sample
+	Probs  [10]float64
+}
+
+// A SoftTrainer is a Classifier which can be trained
+// on target distributions rather than labels.
+type SoftTrainer interface {
+	Classifier
+
+	TrainSoft(data []*SoftSample, validation []*TrainingSample)
+}
+
+// A BinaryClassifier learns to separate samples with
+// a target of 1 from samples with a target of -1.
+type BinaryClassifier interface {
+	serializer.Serializer
+
+	TrainBinary(data []*TrainingSample, targets []float64)
+
+	// Margin returns a confidence score which is
+	// positive for the first group and negative for
+	// the second.
+	Margin(s *Sample) float64
+}
+
+// A Generator is a generative model which can
+// synthesize samples of a given class.
+type Generator interface {
+	Generate(class int, gen *rand.Rand) *Sample
+
+	// Prototype renders a class's typical sample,
+	// moved k standard deviations from the mean.
+	Prototype(class int, k float64) *Sample
+}
+
 // A ClassifierDesc includes a plain-text description
 // of a classifier as well as a constructor for that
 // classifier.
@@ -31,6 +99,31 @@ type ClassifierDesc struct {
 	Construct func() Classifier
 }
 
+// A BinaryClassifierDesc includes a plain-text
+// description of a binary classifier as well as a
+// constructor for it.
+type BinaryClassifierDesc struct {
+	Desc      string
+	Construct func() BinaryClassifier
+}
+
+// BinaryClassifiers stores BinaryClassifierDescs for
+// each available binary classifier.
+var BinaryClassifiers = map[string]BinaryClassifierDesc{
+	"stumps": BinaryClassifierDesc{
+		Desc: "boosted tree stumps",
+		Construct: func() BinaryClassifier {
+			return &BinaryStumps{}
+		},
+	},
+	"svm": BinaryClassifierDesc{
+		Desc: "kernel support vector machine",
+		Construct: func() BinaryClassifier {
+			return &BinarySVM{}
+		},
+	},
+}
+
 // Classifiers stores ClassifierDescs for each available
 // classifier.
 var Classifiers = map[string]ClassifierDesc{
@@ -46,12 +139,108 @@ var Classifiers = map[string]ClassifierDesc{
 			return &Bayes{}
 		},
 	},
+	"bernoulli-bayes": ClassifierDesc{
+		Desc: "naive bayes on binarized pixels",
+		Construct: func() Classifier {
+			return &PixelBayes{}
+		},
+	},
+	"multinomial-bayes": ClassifierDesc{
+		Desc: "naive bayes on pixel intensity counts",
+		Construct: func() Classifier {
+			return &PixelBayes{Multinomial: true}
+		},
+	},
+	"lda": ClassifierDesc{
+		Desc: "linear discriminant analysis",
+		Construct: func() Classifier {
+			return &Discriminant{Shared: true}
+		},
+	},
+	"qda": ClassifierDesc{
+		Desc: "quadratic discriminant analysis",
+		Construct: func() Classifier {
+			return &Discriminant{Shrinkage: discriminantShrinkage}
+		},
+	},
+	"softmax": ClassifierDesc{
+		Desc: "multinomial logistic regression on pixels",
+		Construct: func() Classifier {
+			return &Softmax{L2: softmaxDefaultL2}
+		},
+	},
+	"softmax-pca": ClassifierDesc{
+		Desc: "multinomial logistic regression on principal components",
+		Construct: func() Classifier {
+			return &Softmax{L2: softmaxDefaultL2, PCAComponents: softmaxPCAFeatures}
+		},
+	},
+	"svm": ClassifierDesc{
+		Desc: "kernel support vector machines",
+		Construct: func() Classifier {
+			return &SVM{}
+		},
+	},
+	"gmm": ClassifierDesc{
+		Desc: "gaussian mixtures with full covariances",
+		Construct: func() Classifier {
+			return &GMM{Full: true}
+		},
+	},
+	"gmm-diag": ClassifierDesc{
+		Desc: "gaussian mixtures with diagonal covariances",
+		Construct: func() Classifier {
+			return &GMM{}
+		},
+	},
+	"lvq": ClassifierDesc{
+		Desc: "learning vector quantization",
+		Construct: func() Classifier {
+			return &LVQ{}
+		},
+	},
+	"ecoc": ClassifierDesc{
+		Desc: "error-correcting output codes over binary classifiers",
+		Construct: func() Classifier {
+			return &ECOC{}
+		},
+	},
+	"hierarchy": ClassifierDesc{
+		Desc: "a general model with specialists for confusable digits",
+		Construct: func() Classifier {
+			return &Hierarchy{}
+		},
+	},
+	"cascade": ClassifierDesc{
+		Desc: "cheap models which defer to expensive ones when unsure",
+		Construct: func() Classifier {
+			return &Cascade{}
+		},
+	},
+	"pipeline": ClassifierDesc{
+		Desc: "preprocessing transformers followed by another classifier",
+		Construct: func() Classifier {
+			return &Pipeline{}
+		},
+	},
+	"netfeatures": ClassifierDesc{
+		Desc: "another classifier on the hidden units of a convolutional net",
+		Construct: func() Classifier {
+			return &NetFeatures{}
+		},
+	},
 	"neuralnet": ClassifierDesc{
 		Desc: "a basic convolutional net",
 		Construct: func() Classifier {
 			return NewNeuralNet()
 		},
 	},
+	"small-neuralnet": ClassifierDesc{
+		Desc: "a convolutional net small enough to distill into",
+		Construct: func() Classifier {
+			return NewSmallNeuralNet()
+		},
+	},
 	"neighbors": ClassifierDesc{
 		Desc: "K-nearest neighbors",
 		Construct: func() Classifier {
@@ -64,6 +253,12 @@ var Classifiers = map[string]ClassifierDesc{
 			return &Stumps{}
 		},
 	},
+	"samme": ClassifierDesc{
+		Desc: "multiclass boosted tree stumps (SAMME)",
+		Construct: func() Classifier {
+			return &Stumps{Multiclass: true}
+		},
+	},
 	"rbf": ClassifierDesc{
 		Desc: "rbf networks",
 		Construct: func() Classifier {
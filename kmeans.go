@@ -0,0 +1,111 @@
+package mnistdemo
+
+import (
+	"math"
+	"math/rand"
+
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+const kMeansIterations = 30
+
+// kMeans clusters vectors into k centers using
+// k-means++ seeding followed by Lloyd iterations.
+// It returns the centers and the index of the center
+// assigned to each vector.
+func kMeans(data []linalg.Vector, k int) (centers []linalg.Vector, assignments []int) {
+	centers = kMeansSeeds(data, k)
+	for iter := 0; iter < kMeansIterations; iter++ {
+		newAssignments := make([]int, len(data))
+		parallelFor(len(data), func(i int) {
+			newAssignments[i], _ = nearestCenter(centers, data[i])
+		})
+		changed := assignments == nil
+		for i, idx := range newAssignments {
+			if !changed && idx != assignments[i] {
+				changed = true
+			}
+		}
+		assignments = newAssignments
+		if !changed {
+			break
+		}
+
+		counts := make([]int, k)
+		newCenters := make([]linalg.Vector, k)
+		for i := range newCenters {
+			newCenters[i] = make(linalg.Vector, len(data[0]))
+		}
+		for i, v := range data {
+			counts[assignments[i]]++
+			for j, x := range v {
+				newCenters[assignments[i]][j] += x
+			}
+		}
+		for i, center := range newCenters {
+			if counts[i] == 0 {
+				// Keep empty clusters where they were.
+				newCenters[i] = centers[i]
+				continue
+			}
+			for j := range center {
+				center[j] /= float64(counts[i])
+			}
+		}
+		centers = newCenters
+	}
+	return
+}
+
+// kMeansSeeds picks k initial centers with k-means++,
+// favoring vectors far from the centers chosen so
+// far.
+func kMeansSeeds(data []linalg.Vector, k int) []linalg.Vector {
+	centers := []linalg.Vector{append(linalg.Vector{}, data[rand.Intn(len(data))]...)}
+	dists := make([]float64, len(data))
+	for i := range dists {
+		dists[i] = math.Inf(1)
+	}
+	for len(centers) < k {
+		last := centers[len(centers)-1]
+		var total float64
+		for i, v := range data {
+			dists[i] = math.Min(dists[i], squaredDist(last, v))
+			total += dists[i]
+		}
+		target := rand.Float64() * total
+		choice := len(data) - 1
+		for i, d := range dists {
+			target -= d
+			if target <= 0 {
+				choice = i
+				break
+			}
+		}
+		centers = append(centers, append(linalg.Vector{}, data[choice]...))
+	}
+	return centers
+}
+
+// nearestCenter finds the center closest to v and
+// the squared distance to it.
+func nearestCenter(centers []linalg.Vector, v linalg.Vector) (int, float64) {
+	bestIdx := 0
+	bestDist := math.Inf(1)
+	for i, c := range centers {
+		if d := squaredDist(c, v); d < bestDist {
+			bestDist = d
+			bestIdx = i
+		}
+	}
+	return bestIdx, bestDist
+}
+
+func squaredDist(v1, v2 linalg.Vector) float64 {
+	var res float64
+	for i, x := range v1 {
+		d := x - v2[i]
+		res += d * d
+	}
+	return res
+}
@@ -0,0 +1,323 @@
+package mnistdemo
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"image"
+	"log"
+	"math"
+	"math/rand"
+
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+)
+
+const (
+	lvqSerializerID = "github.com/unixpickle/mnistdemo.LVQ"
+
+	lvqDefaultPrototypes = 10
+	lvqDefaultEpochs     = 10
+	lvqDefaultWindow     = 0.3
+	lvqKMeansSubset      = 20000
+)
+
+// Training rules for LVQ.
+const (
+	LVQ1  = "lvq1"
+	LVQ21 = "lvq2.1"
+	GLVQ  = "glvq"
+)
+
+var lvqDefaultSteps = map[string]float64{
+	LVQ1:  0.05,
+	LVQ21: 0.03,
+	GLVQ:  0.5,
+}
+
+func init() {
+	serializer.RegisterTypedDeserializer(lvqSerializerID, DeserializeLVQ)
+}
+
+// LVQ is a learning vector quantization classifier,
+// which labels a sample with the class of its nearest
+// prototype.
+//
+// Prototypes are stored as bytes, like the images of
+// Neighbors.
+// They are initialized with per-class k-means and
+// then trained with Rule (LVQ1, LVQ21 or GLVQ,
+// defaulting to GLVQ).
+// PerClass defaults to 10 prototypes, Epochs to 10,
+// and StepSize to a rule-specific value which decays
+// linearly to zero.
+// Window is the relative window width for LVQ2.1.
+type LVQ struct {
+	Prototypes [10][][]byte
+
+	Rule     string
+	PerClass int
+	Epochs   int
+	StepSize float64
+	Window   float64
+}
+
+// DeserializeLVQ deserializes an LVQ that was
+// serialized with LVQ.Serialize().
+func DeserializeLVQ(d []byte) (*LVQ, error) {
+	dec, err := decompress(d)
+	if err != nil {
+		return nil, err
+	}
+	gobReader := gob.NewDecoder(bytes.NewBuffer(dec))
+	var res LVQ
+	if err := gobReader.Decode(&res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Validate checks that the rule is known.
+func (l *LVQ) Validate() error {
+	if _, ok := lvqDefaultSteps[l.rule()]; !ok {
+		return errors.New("unknown LVQ rule: " + l.Rule)
+	}
+	return nil
+}
+
+// Train initializes and trains the prototypes.
+func (l *LVQ) Train(data, validation []*TrainingSample) {
+	if err := l.Validate(); err != nil {
+		panic(err)
+	}
+	rule := l.rule()
+	step := l.StepSize
+	if step == 0 {
+		step = lvqDefaultSteps[rule]
+	}
+	perClass := l.PerClass
+	if perClass == 0 {
+		perClass = lvqDefaultPrototypes
+	}
+	epochs := l.Epochs
+	if epochs == 0 {
+		epochs = lvqDefaultEpochs
+	}
+
+	log.Println("Clustering prototypes...")
+	protos, labels := lvqInitialPrototypes(data, perClass)
+	trainer := &lvqTrainer{
+		Prototypes: protos,
+		Labels:     labels,
+		Rule:       rule,
+		Window:     l.Window,
+	}
+	if trainer.Window == 0 {
+		trainer.Window = lvqDefaultWindow
+	}
+
+	log.Printf("Training %d prototypes with %s...", len(protos), rule)
+	total := epochs * len(data)
+	for epoch := 0; epoch < epochs; epoch++ {
+		var correct int
+		for i, j := range rand.Perm(len(data)) {
+			progress := float64(epoch*len(data)+i) / float64(total)
+			if trainer.Update(data[j], step*(1-progress)) {
+				correct++
+			}
+		}
+		log.Printf("Epoch %d: training accuracy %d/%d", epoch+1, correct, len(data))
+	}
+
+	for i := range l.Prototypes {
+		l.Prototypes[i] = nil
+	}
+	for i, proto := range protos {
+		var s Sample
+		copy(s[:], proto)
+		s.clip()
+		l.Prototypes[labels[i]] = append(l.Prototypes[labels[i]], sampleBytes(&s))
+	}
+
+	log.Println("Running cross validation...")
+	var correct int
+	for _, x := range validation {
+		if l.Classify(x.Sample) == x.Label {
+			correct++
+		}
+	}
+	log.Printf("Got %d/%d", correct, len(validation))
+}
+
+// Classify returns the class of the nearest
+// prototype.
+func (l *LVQ) Classify(s *Sample) int {
+	scores := l.Scores(s)
+	return maxIndex(scores[:])
+}
+
+// Scores returns the negative squared distance from
+// the sample to each class's nearest prototype.
+func (l *LVQ) Scores(s *Sample) [10]float64 {
+	var res [10]float64
+	for class, protos := range l.Prototypes {
+		res[class] = math.Inf(-1)
+		for _, proto := range protos {
+			dot, sampleMag, protoMag := templateDot(s[:], proto)
+			res[class] = math.Max(res[class], 2*dot-sampleMag-protoMag)
+		}
+	}
+	return res
+}
+
+// RenderImages renders the prototypes of each class
+// in turn, so rendering with one column per
+// prototype gives one row per class.
+func (l *LVQ) RenderImages() []image.Image {
+	var res []image.Image
+	for _, protos := range l.Prototypes {
+		for _, proto := range protos {
+			var s Sample
+			for i, b := range proto {
+				s[i] = float64(b) / 255
+			}
+			res = append(res, s.Image())
+		}
+	}
+	return res
+}
+
+func (l *LVQ) rule() string {
+	if l.Rule == "" {
+		return GLVQ
+	}
+	return l.Rule
+}
+
+func (l *LVQ) SerializerType() string {
+	return lvqSerializerID
+}
+
+func (l *LVQ) Serialize() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(l); err != nil {
+		return nil, err
+	}
+	return compress(buf.Bytes()), nil
+}
+
+// lvqInitialPrototypes clusters each class of a
+// random subset of the data.
+func lvqInitialPrototypes(data []*TrainingSample, perClass int) ([]linalg.Vector, []int) {
+	subset := data
+	if len(subset) > lvqKMeansSubset {
+		subset = make([]*TrainingSample, lvqKMeansSubset)
+		for i, j := range rand.Perm(len(data))[:len(subset)] {
+			subset[i] = data[j]
+		}
+	}
+	var protos []linalg.Vector
+	var labels []int
+	for class := 0; class < 10; class++ {
+		var classData []linalg.Vector
+		for _, x := range subset {
+			if x.Label == class {
+				classData = append(classData, x.Sample[:])
+			}
+		}
+		if len(classData) == 0 {
+			continue
+		}
+		centers, _ := kMeans(classData, minInt(perClass, len(classData)))
+		for _, c := range centers {
+			protos = append(protos, append(linalg.Vector{}, c...))
+			labels = append(labels, class)
+		}
+	}
+	return protos, labels
+}
+
+// lvqTrainer applies online LVQ updates to a set of
+// labelled prototypes.
+type lvqTrainer struct {
+	Prototypes []linalg.Vector
+	Labels     []int
+	Rule       string
+	Window     float64
+}
+
+// Update applies one update for a sample and
+// reports whether the sample was classified
+// correctly beforehand.
+func (l *lvqTrainer) Update(sample *TrainingSample, step float64) bool {
+	// Find the nearest prototype overall, and the
+	// nearest prototype with and without the label.
+	nearest, nearestRight, nearestWrong := -1, -1, -1
+	dists := make([]float64, len(l.Prototypes))
+	for i, proto := range l.Prototypes {
+		dists[i] = squaredDist(proto, sample.Sample[:])
+		if nearest == -1 || dists[i] < dists[nearest] {
+			nearest = i
+		}
+		if l.Labels[i] == sample.Label {
+			if nearestRight == -1 || dists[i] < dists[nearestRight] {
+				nearestRight = i
+			}
+		} else if nearestWrong == -1 || dists[i] < dists[nearestWrong] {
+			nearestWrong = i
+		}
+	}
+	correct := l.Labels[nearest] == sample.Label
+	if nearestRight == -1 || nearestWrong == -1 {
+		return correct
+	}
+
+	switch l.Rule {
+	case LVQ1:
+		if correct {
+			l.move(nearest, sample, step)
+		} else {
+			l.move(nearest, sample, -step)
+		}
+	case LVQ21:
+		// Only update when the sample falls in a window
+		// around the boundary between the two nearest
+		// prototypes.
+		second := nearestRight
+		if correct {
+			second = nearestWrong
+		}
+		d1, d2 := math.Sqrt(dists[nearest]), math.Sqrt(dists[second])
+		ratio := math.Min(d1/d2, d2/d1)
+		if l.Labels[second] != l.Labels[nearest] &&
+			ratio > (1-l.Window)/(1+l.Window) {
+			l.move(nearestRight, sample, step)
+			l.move(nearestWrong, sample, -step)
+		}
+	case GLVQ:
+		// Minimize sigmoid((d1-d2)/(d1+d2)).
+		d1, d2 := dists[nearestRight], dists[nearestWrong]
+		denom := (d1 + d2) * (d1 + d2)
+		if denom == 0 {
+			return correct
+		}
+		mu := (d1 - d2) / (d1 + d2)
+		f := 1 / (1 + math.Exp(-mu))
+		scale := f * (1 - f) * 4
+		l.move(nearestRight, sample, step*scale*d2/denom)
+		l.move(nearestWrong, sample, -step*scale*d1/denom)
+	default:
+		panic("unknown LVQ rule: " + l.Rule)
+	}
+	return correct
+}
+
+// move moves a prototype towards a sample (or away,
+// for negative steps).
+func (l *lvqTrainer) move(proto int, sample *TrainingSample, step float64) {
+	p := l.Prototypes[proto]
+	for i, x := range sample.Sample {
+		p[i] += step * (x - p[i])
+	}
+}
@@ -0,0 +1,77 @@
+package mnistdemo
+
+import (
+	"errors"
+	"math"
+
+	"github.com/unixpickle/num-analysis/linalg"
+)
+
+// cholesky computes the lower-triangular matrix L
+// such that L*L^T equals the symmetric positive
+// definite matrix m.
+func cholesky(m *linalg.Matrix) (*linalg.Matrix, error) {
+	n := m.Rows
+	res := linalg.NewMatrix(n, n)
+	for i := 0; i < n; i++ {
+		for j := 0; j <= i; j++ {
+			sum := m.Data[i*n+j]
+			for k := 0; k < j; k++ {
+				sum -= res.Data[i*n+k] * res.Data[j*n+k]
+			}
+			if i == j {
+				if sum <= 0 {
+					return nil, errors.New("matrix is not positive definite")
+				}
+				res.Data[i*n+i] = math.Sqrt(sum)
+			} else {
+				res.Data[i*n+j] = sum / res.Data[j*n+j]
+			}
+		}
+	}
+	return res, nil
+}
+
+// choleskyLogDet computes the log determinant of
+// L*L^T given the Cholesky factor L.
+func choleskyLogDet(l *linalg.Matrix) float64 {
+	var res float64
+	for i := 0; i < l.Rows; i++ {
+		res += 2 * math.Log(l.Data[i*l.Cols+i])
+	}
+	return res
+}
+
+// choleskyMahalanobis computes x^T*(L*L^T)^-1*x given
+// the Cholesky factor L.
+func choleskyMahalanobis(l *linalg.Matrix, x []float64) float64 {
+	n := l.Rows
+	y := make([]float64, n)
+	var res float64
+	for i := 0; i < n; i++ {
+		sum := x[i]
+		for k := 0; k < i; k++ {
+			sum -= l.Data[i*n+k] * y[k]
+		}
+		y[i] = sum / l.Data[i*n+i]
+		res += y[i] * y[i]
+	}
+	return res
+}
+
+// shrinkCovariance blends a covariance matrix with a
+// scaled identity matrix of the same trace, pulling
+// it towards a spherical covariance.
+func shrinkCovariance(m *linalg.Matrix, shrinkage float64) {
+	n := m.Rows
+	var trace float64
+	for i := 0; i < n; i++ {
+		trace += m.Data[i*n+i]
+	}
+	for i := range m.Data {
+		m.Data[i] *= 1 - shrinkage
+	}
+	for i := 0; i < n; i++ {
+		m.Data[i*n+i] += shrinkage * trace / float64(n)
+	}
+}
@@ -22,9 +22,15 @@ func init() {
 	serializer.RegisterTypedDeserializer(neighborsSerializerID, DeserializeNeighbors)
 }
 
+// Neighbors is a k-nearest-neighbors classifier
+// using cosine similarity.
+//
+// If Features is set, neighbors are compared by its
+// features rather than by their pixels.
 type Neighbors struct {
-	Images [10][][]byte
-	K      int
+	Images   [10][][]byte
+	K        int
+	Features *FeatureExtractor
 }
 
 func DeserializeNeighbors(d []byte) (*Neighbors, error) {
@@ -43,7 +49,7 @@ func DeserializeNeighbors(d []byte) (*Neighbors, error) {
 func (n *Neighbors) Train(data, validation []*TrainingSample) {
 	log.Println("Choosing samples...")
 	for i := 0; i < 10; i++ {
-		n.Images[i] = neighborSamples(data, i)
+		n.Images[i] = n.neighborSamples(data, i)
 	}
 	log.Println("Selecting K value...")
 	kScores := map[int]int{}
@@ -70,6 +76,17 @@ func (n *Neighbors) Classify(s *Sample) int {
 	return keyForMaxCount(counts)
 }
 
+// Scores returns the fraction of the K nearest
+// neighbors in each class.
+func (n *Neighbors) Scores(s *Sample) [10]float64 {
+	res := n.resultsForSample(s)
+	var scores [10]float64
+	for i := 0; i < n.K; i++ {
+		scores[res.Labels[i]] += 1 / float64(n.K)
+	}
+	return scores
+}
+
 func (n *Neighbors) SerializerType() string {
 	return neighborsSerializerID
 }
@@ -95,9 +112,10 @@ func (n *Neighbors) crossScore(validation []*TrainingSample) int {
 
 func (n *Neighbors) resultsForSample(s *Sample) *classifierResults {
 	var res classifierResults
+	inputs := n.Features.Inputs(s)
 	for label, examples := range n.Images[:] {
 		for _, example := range examples {
-			dist := 1 - cosineDistance(s, example)
+			dist := 1 - cosineDistance(inputs, example)
 			res.Distances = append(res.Distances, dist)
 			res.Labels = append(res.Labels, label)
 		}
@@ -106,28 +124,11 @@ func (n *Neighbors) resultsForSample(s *Sample) *classifierResults {
 	return &res
 }
 
-func cosineDistance(s *Sample, template []byte) float64 {
-	var dotProduct float64
-	var sampleMag float64
-	var templateMag float64
-	for i, x := range s {
-		y := float64(template[i]) / 255
-		dotProduct += x * y
-		sampleMag += x * x
-		templateMag += y * y
-	}
-	return dotProduct / math.Sqrt(sampleMag*templateMag)
-}
-
-func neighborSamples(data []*TrainingSample, label int) [][]byte {
+func (n *Neighbors) neighborSamples(data []*TrainingSample, label int) [][]byte {
 	var allSamples [][]byte
 	for _, x := range data {
 		if x.Label == label {
-			byteList := make([]byte, len(x.Sample))
-			for i, f := range x.Sample[:] {
-				byteList[i] = byte(f*255 + 0.5)
-			}
-			allSamples = append(allSamples, byteList)
+			allSamples = append(allSamples, vectorBytes(n.Features.Inputs(x.Sample)))
 		}
 	}
 	perm := rand.Perm(len(allSamples))
@@ -139,6 +140,40 @@ func neighborSamples(data []*TrainingSample, label int) [][]byte {
 	return res
 }
 
+func cosineDistance(v []float64, template []byte) float64 {
+	dotProduct, sampleMag, templateMag := templateDot(v, template)
+	return dotProduct / math.Sqrt(sampleMag*templateMag)
+}
+
+// templateDot computes the dot product between a
+// vector and a byte template, along with their
+// squared magnitudes.
+func templateDot(v []float64, template []byte) (dot, sampleMag, templateMag float64) {
+	for i, x := range v {
+		y := float64(template[i]) / 255
+		dot += x * y
+		sampleMag += x * x
+		templateMag += y * y
+	}
+	return
+}
+
+// sampleBytes quantizes a sample's intensities to
+// bytes.
+func sampleBytes(s *Sample) []byte {
+	return vectorBytes(s[:])
+}
+
+// vectorBytes quantizes values between 0 and 1 to
+// bytes, clamping values outside that range.
+func vectorBytes(v []float64) []byte {
+	res := make([]byte, len(v))
+	for i, f := range v {
+		res[i] = byte(math.Max(0, math.Min(1, f))*255 + 0.5)
+	}
+	return res
+}
+
 func keyForMaxCount(m map[int]int) int {
 	var bestKey int
 	bestCount := -1
@@ -0,0 +1,196 @@
+package mnistdemo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/unixpickle/serializer"
+)
+
+const (
+	netFeaturesSerializerID = "github.com/unixpickle/mnistdemo.NetFeatures"
+
+	netFeaturesDefaultLayer = NeuralNetLayerHidden
+	netFeaturesDefaultInner = "neighbors"
+)
+
+func init() {
+	serializer.RegisterTypedDeserializer(netFeaturesSerializerID, DeserializeNetFeatures)
+}
+
+// NetFeatures classifies samples by the activations
+// of one layer of a NeuralNet.
+//
+// Layer names the layer (NeuralNetLayerPool or
+// NeuralNetLayerHidden), defaulting to the hidden
+// layer.
+// Inner names the model in Classifiers which is
+// trained on the activations, defaulting to
+// "neighbors".
+// The model must take a FeatureExtractor (Forest,
+// Stumps, Neighbors, Bayes or SVM), which is set to
+// compute the activations.
+//
+// If Net is nil before training, a NeuralNet is
+// trained on the data first, using Config.
+// After training, Net only contains the layers up to
+// Layer.
+type NetFeatures struct {
+	Layer string
+	Inner string
+
+	Net    *NeuralNet
+	Model  Classifier
+	Config *TrainConfig
+}
+
+// netFeaturesArchive is the serialized form of
+// NetFeatures.
+type netFeaturesArchive struct {
+	Layer string
+	Inner string
+	Net   []byte
+	Model []byte
+}
+
+// DeserializeNetFeatures deserializes NetFeatures
+// that were serialized with NetFeatures.Serialize().
+func DeserializeNetFeatures(d []byte) (*NetFeatures, error) {
+	data, err := decompress(d)
+	if err != nil {
+		return nil, err
+	}
+	var archive netFeaturesArchive
+	if err := json.Unmarshal(data, &archive); err != nil {
+		return nil, err
+	}
+	res := &NetFeatures{Layer: archive.Layer, Inner: archive.Inner}
+	res.Net, err = DeserializeNeuralNet(archive.Net)
+	if err != nil {
+		return nil, err
+	}
+	res.Model, err = deserializeClassifier(archive.Model)
+	if err != nil {
+		return nil, err
+	}
+	extractor := featureExtractorOf(res.Model)
+	if extractor == nil {
+		return nil, fmt.Errorf("model cannot use network features: %T", res.Model)
+	}
+	*extractor = netFeatureExtractor(res.Net)
+	return res, nil
+}
+
+// Validate checks that the layer can be extracted
+// and that the model can be trained on it, so that
+// mistakes are caught before the network is trained.
+func (n *NetFeatures) Validate() error {
+	switch n.Layer {
+	case "", NeuralNetLayerPool, NeuralNetLayerHidden:
+	default:
+		return errors.New("unsupported network layer: " + n.Layer)
+	}
+	model := n.Model
+	if model == nil {
+		name := n.Inner
+		if name == "" {
+			name = netFeaturesDefaultInner
+		}
+		desc, ok := Classifiers[name]
+		if !ok {
+			return errors.New("unknown classifier: " + name)
+		}
+		model = desc.Construct()
+	}
+	if featureExtractorOf(model) == nil {
+		return fmt.Errorf("model cannot use network features: %T", model)
+	}
+	return nil
+}
+
+// Train truncates the network (training it first if
+// necessary) and trains the model on its
+// activations.
+func (n *NetFeatures) Train(data, validation []*TrainingSample) {
+	if err := n.Validate(); err != nil {
+		panic(err)
+	}
+	if n.Net == nil {
+		log.Println("Training network...")
+		n.Net = NewNeuralNet()
+		n.Net.Config = n.Config
+		n.Net.Train(data, validation)
+	}
+	layer := n.Layer
+	if layer == "" {
+		layer = netFeaturesDefaultLayer
+	}
+	net, err := n.Net.Truncate(layer)
+	if err != nil {
+		panic(err)
+	}
+	n.Net = net
+
+	if n.Model == nil {
+		n.Model = constructClassifier(n.Inner, netFeaturesDefaultInner)
+	}
+	*featureExtractorOf(n.Model) = netFeatureExtractor(net)
+	// The model reports its own validation accuracy,
+	// which is that of the whole composite.
+	log.Println("Training model...")
+	n.Model.Train(data, validation)
+}
+
+// Classify classifies the sample's activations.
+func (n *NetFeatures) Classify(s *Sample) int {
+	return n.Model.Classify(s)
+}
+
+// SerializerType returns the unique ID used to
+// serialize NetFeatures.
+func (n *NetFeatures) SerializerType() string {
+	return netFeaturesSerializerID
+}
+
+// Serialize serializes the truncated network along
+// with the model.
+func (n *NetFeatures) Serialize() ([]byte, error) {
+	archive := &netFeaturesArchive{
+		Layer: n.Layer,
+		Inner: n.Inner,
+	}
+	var err error
+	archive.Net, err = n.Net.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	archive.Model, err = serializer.SerializeWithType(n.Model)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(archive)
+	if err != nil {
+		return nil, err
+	}
+	return compress(data), nil
+}
+
+// featureExtractorOf returns a pointer to a model's
+// FeatureExtractor, or nil if the model has none.
+func featureExtractorOf(model Classifier) **FeatureExtractor {
+	switch model := model.(type) {
+	case *Forest:
+		return &model.Features
+	case *Stumps:
+		return &model.Features
+	case *Neighbors:
+		return &model.Features
+	case *Bayes:
+		return &model.Features
+	case *SVM:
+		return &model.Features
+	}
+	return nil
+}
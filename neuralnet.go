@@ -1,8 +1,13 @@
 package mnistdemo
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"math"
+	"math/rand"
+	"sync"
 
 	"github.com/unixpickle/autofunc"
 	"github.com/unixpickle/num-analysis/linalg"
@@ -14,14 +19,39 @@ import (
 const (
 	neuralnetSerializerID = "github.com/unixpickle/mnistdemo.NeuralNet"
 	neuralnetFilterCount  = 8
+	neuralnetHiddenCount  = 300
+
+	neuralnetSmallFilterCount = 4
+	neuralnetSmallHiddenCount = 32
+)
+
+// Names of the NeuralNet layers whose activations
+// can be extracted.
+const (
+	NeuralNetLayerPool   = "pool"
+	NeuralNetLayerHidden = "hidden"
 )
 
 func init() {
 	serializer.RegisterTypedDeserializer(neuralnetSerializerID, DeserializeNeuralNet)
 }
 
+// A NeuralNet is a convolutional neural network.
+//
+// Config configures training and Metadata records
+// how the network was trained.
 type NeuralNet struct {
 	Net neuralnet.Network
+
+	Config   *TrainConfig
+	Metadata *TrainMetadata
+
+	// fresh is set until a newly constructed network
+	// is trained, since only such networks may be
+	// re-initialized with Config.Seed.
+	fresh bool
+
+	engine *inferenceEngine
 }
 
 func DeserializeNeuralNet(d []byte) (*NeuralNet, error) {
@@ -29,16 +59,30 @@ func DeserializeNeuralNet(d []byte) (*NeuralNet, error) {
 	if err != nil {
 		return nil, errors.New("failed to decompress network: " + err.Error())
 	}
-	nn, err := neuralnet.DeserializeNetwork(dec)
+	raw, meta := unarchiveNetwork(dec)
+	nn, err := neuralnet.DeserializeNetwork(raw)
 	if err != nil {
 		return nil, err
 	}
-	return &NeuralNet{Net: nn}, nil
+	res := &NeuralNet{Net: nn, Metadata: meta}
+	res.compile()
+	return res, nil
 }
 
 func NewNeuralNet() *NeuralNet {
+	return newNeuralNet(neuralnetFilterCount, neuralnetHiddenCount)
+}
+
+// NewSmallNeuralNet creates a network with fewer
+// filters and hidden units than NewNeuralNet, for use
+// as a distillation student.
+func NewSmallNeuralNet() *NeuralNet {
+	return newNeuralNet(neuralnetSmallFilterCount, neuralnetSmallHiddenCount)
+}
+
+func newNeuralNet(filters, hidden int) *NeuralNet {
 	convLayer := &neuralnet.ConvLayer{
-		FilterCount:  neuralnetFilterCount,
+		FilterCount:  filters,
 		FilterWidth:  3,
 		FilterHeight: 3,
 		Stride:       1,
@@ -51,41 +95,60 @@ func NewNeuralNet() *NeuralNet {
 		YSpan:       3,
 		InputWidth:  convLayer.OutputWidth(),
 		InputHeight: convLayer.OutputHeight(),
-		InputDepth:  neuralnetFilterCount,
+		InputDepth:  filters,
 	}
 	net := neuralnet.Network{
 		convLayer,
 		&neuralnet.Sigmoid{},
 		pool,
 		&neuralnet.DenseLayer{
-			InputCount: pool.OutputWidth() * pool.OutputHeight() *
-				neuralnetFilterCount,
-			OutputCount: 300,
+			InputCount:  pool.OutputWidth() * pool.OutputHeight() * filters,
+			OutputCount: hidden,
 		},
 		&neuralnet.Sigmoid{},
 		&neuralnet.DenseLayer{
-			InputCount:  300,
+			InputCount:  hidden,
 			OutputCount: 10,
 		},
 		&neuralnet.LogSoftmaxLayer{},
 	}
 	net.Randomize()
-	return &NeuralNet{Net: net}
+	res := &NeuralNet{Net: net, fresh: true}
+	res.compile()
+	return res
 }
 
 func (n *NeuralNet) Train(data, validation []*TrainingSample) {
+	n.train(neuralnetSampleSet(data), validation)
+}
+
+// TrainSoft trains the network to match target
+// distributions, minimizing cross-entropy.
+func (n *NeuralNet) TrainSoft(data []*SoftSample, validation []*TrainingSample) {
+	var inputVecs, targetVecs []linalg.Vector
+	for _, x := range data {
+		inputVecs = append(inputVecs, x.Sample[:])
+		targetVecs = append(targetVecs, append(linalg.Vector{}, x.Probs[:]...))
+	}
+	n.train(neuralnet.VectorSampleSet(inputVecs, targetVecs), validation)
+}
+
+func (n *NeuralNet) train(samples sgd.SampleSet, validation []*TrainingSample) {
 	log.Println("Training classifier (ctrl+c to stop)...")
 
-	samples := neuralnetSampleSet(data)
-	gradienter := &neuralnet.BatchRGradienter{
-		Learner:  n.Net.BatchLearner(),
-		CostFunc: neuralnet.DotCost{},
+	config := n.Config.withDefaults()
+	if config.Seed != 0 && n.fresh {
+		randomizeNetwork(n.Net, rand.New(rand.NewSource(config.Seed)))
 	}
-	adam := &sgd.Adam{Gradienter: gradienter}
-	sgd.SGDInteractive(adam, samples, 0.001, 50, func() bool {
-		log.Println("Mid-training score:", n.score(validation))
-		return true
+	n.fresh = false
+	n.compile()
+	log.Printf("Computing gradients with %d workers.", config.Workers)
+
+	gradienter := n.Gradienter(config.Workers)
+	n.Metadata = trainGradient(config, gradienter, n.Net, samples, func() float64 {
+		return n.score(validation)
 	})
+	n.compile()
 
 	log.Println("Running cross validation...")
 	var correct, total int
@@ -98,20 +161,93 @@ func (n *NeuralNet) Train(data, validation []*TrainingSample) {
 	log.Printf("Got %d/%d", correct, total)
 }
 
+// Gradienter creates a Gradienter for the network's
+// cost which splits every minibatch between the
+// given number of goroutines.
+// For a fixed number of workers, gradients are
+// always summed in the same order, so results are
+// reproducible.
+func (n *NeuralNet) Gradienter(workers int) sgd.Gradienter {
+	newGradienter := func() sgd.Gradienter {
+		return &neuralnet.BatchRGradienter{
+			Learner:  n.Net.BatchLearner(),
+			CostFunc: neuralnet.DotCost{},
+		}
+	}
+	if workers <= 1 {
+		return newGradienter()
+	}
+	res := &parallelGradienter{Params: n.Net.Parameters()}
+	for i := 0; i < workers; i++ {
+		res.Workers = append(res.Workers, newGradienter())
+	}
+	return res
+}
+
 func (n *NeuralNet) Classify(s *Sample) int {
+	if n.engine != nil {
+		return n.engine.Classify(s[:])
+	}
+	scores := n.Scores(s)
+	return maxIndex(scores[:])
+}
+
+// Scores returns the network's log probabilities.
+func (n *NeuralNet) Scores(s *Sample) [10]float64 {
+	var res [10]float64
+	if n.engine != nil {
+		n.engine.Apply(s[:], func(out []float64) {
+			copy(res[:], out)
+		})
+		return res
+	}
 	inVar := &autofunc.Variable{Vector: s[:]}
-	output := n.Net.Apply(inVar).Output()
-
-	var greatestVal float64
-	var greatestIdx int
-	for i, x := range output {
-		if i == 0 || x > greatestVal {
-			greatestVal = x
-			greatestIdx = i
-		}
+	copy(res[:], n.Net.Apply(inVar).Output())
+	return res
+}
+
+// Output runs the network on a sample and returns
+// its whole output vector.
+func (n *NeuralNet) Output(s *Sample) []float64 {
+	if n.engine != nil {
+		var res []float64
+		n.engine.Apply(s[:], func(out []float64) {
+			res = append(res, out...)
+		})
+		return res
 	}
+	inVar := &autofunc.Variable{Vector: s[:]}
+	return n.Net.Apply(inVar).Output()
+}
 
-	return greatestIdx
+// Activations runs the network up to a named layer
+// and returns the layer's activations.
+// To extract activations from many samples, it is
+// faster to Truncate the network once.
+func (n *NeuralNet) Activations(s *Sample, layer string) ([]float64, error) {
+	end, err := n.layerEnd(layer)
+	if err != nil {
+		return nil, err
+	}
+	inVar := &autofunc.Variable{Vector: s[:]}
+	return n.Net[:end].Apply(inVar).Output(), nil
+}
+
+// Truncate creates a network which outputs the
+// activations of a named layer instead of class
+// scores.
+// The new network shares its parameters with n.
+func (n *NeuralNet) Truncate(layer string) (*NeuralNet, error) {
+	end, err := n.layerEnd(layer)
+	if err != nil {
+		return nil, err
+	}
+	res := &NeuralNet{
+		Net:      append(neuralnet.Network{}, n.Net[:end]...),
+		Metadata: n.Metadata,
+	}
+	res.compile()
+	return res, nil
 }
 
 func (n *NeuralNet) SerializerType() string {
@@ -123,7 +259,51 @@ func (n *NeuralNet) Serialize() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return compress(raw), nil
+	return archiveNetwork(raw, n.Metadata)
+}
+
+// Parameters returns the network's trainable
+// parameters.
+func (n *NeuralNet) Parameters() []*autofunc.Variable {
+	return n.Net.Parameters()
+}
+
+// compile builds the fast inference path for the
+// network, falling back on autodiff if the network
+// cannot be compiled.
+func (n *NeuralNet) compile() {
+	engine, err := compileNetwork(n.Net, 28*28)
+	if err != nil {
+		log.Println("Using autodiff for inference:", err)
+	}
+	n.engine = engine
+}
+
+// layerEnd finds the number of leading layers which
+// compute a named layer's activations.
+// The pool layer ends with the max-pooling layer, and
+// the hidden layer ends with the second sigmoid.
+func (n *NeuralNet) layerEnd(layer string) (int, error) {
+	switch layer {
+	case NeuralNetLayerPool, NeuralNetLayerHidden:
+	default:
+		return 0, errors.New("unknown layer: " + layer)
+	}
+	var sigmoids int
+	for i, l := range n.Net {
+		switch l.(type) {
+		case *neuralnet.Sigmoid:
+			sigmoids++
+			if layer == NeuralNetLayerHidden && sigmoids == 2 {
+				return i + 1, nil
+			}
+		case *neuralnet.MaxPoolingLayer:
+			if layer == NeuralNetLayerPool {
+				return i + 1, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("network has no %s layer", layer)
 }
 
 func (n *NeuralNet) score(v []*TrainingSample) float64 {
@@ -137,6 +317,32 @@ func (n *NeuralNet) score(v []*TrainingSample) float64 {
 	return float64(correct) / float64(total)
 }
 
+// randomizeNetwork initializes the weights and biases
+// of every convolutional and dense layer uniformly
+// with variance 1/fan-in, drawing from gen rather
+// than the global generator.
+func randomizeNetwork(net neuralnet.Network, gen *rand.Rand) {
+	fill := func(v []float64, fanIn int) {
+		scale := math.Sqrt(3 / float64(fanIn))
+		for i := range v {
+			v[i] = scale * (2*gen.Float64() - 1)
+		}
+	}
+	for _, layer := range net {
+		switch layer := layer.(type) {
+		case *neuralnet.ConvLayer:
+			fanIn := layer.FilterWidth * layer.FilterHeight * layer.InputDepth
+			for _, filter := range layer.Filters {
+				fill(filter.Data, fanIn)
+			}
+			fill(layer.Biases.Vector, fanIn)
+		case *neuralnet.DenseLayer:
+			fill(layer.Weights.Data.Vector, layer.InputCount)
+			fill(layer.Biases.Var.Vector, layer.InputCount)
+		}
+	}
+}
+
 func neuralnetSampleSet(data []*TrainingSample) sgd.SampleSet {
 	var inputVecs, labelVecs []linalg.Vector
 	for _, t := range data {
@@ -153,3 +359,81 @@ func neuralnetSample(t *TrainingSample) (inVec, outVec linalg.Vector) {
 	outVec[t.Label] = 1
 	return
 }
+
+// networkArchive stores a serialized network along
+// with its training metadata.
+type networkArchive struct {
+	Net      []byte
+	Metadata *TrainMetadata
+}
+
+func archiveNetwork(raw []byte, meta *TrainMetadata) ([]byte, error) {
+	data, err := json.Marshal(&networkArchive{Net: raw, Metadata: meta})
+	if err != nil {
+		return nil, err
+	}
+	return compress(data), nil
+}
+
+// unarchiveNetwork extracts a serialized network and
+// its metadata.
+// Older models stored the bare network, in which
+// case the metadata is nil.
+func unarchiveNetwork(dec []byte) ([]byte, *TrainMetadata) {
+	var archive networkArchive
+	if err := json.Unmarshal(dec, &archive); err != nil || archive.Net == nil {
+		return dec, nil
+	}
+	return archive.Net, archive.Metadata
+}
+
+// parallelGradienter splits each minibatch into
+// contiguous shards, one per worker, computes the
+// shard gradients concurrently, and sums them in
+// shard order.
+type parallelGradienter struct {
+	Workers []sgd.Gradienter
+	Params  []*autofunc.Variable
+
+	result autofunc.Gradient
+}
+
+func (p *parallelGradienter) Gradient(set sgd.SampleSet) autofunc.Gradient {
+	if p.result == nil {
+		p.result = autofunc.Gradient{}
+		for _, param := range p.Params {
+			p.result[param] = make(linalg.Vector, len(param.Vector))
+		}
+	}
+
+	shardCount := len(p.Workers)
+	if set.Len() < shardCount {
+		shardCount = set.Len()
+	}
+	shards := make([]autofunc.Gradient, shardCount)
+	var wg sync.WaitGroup
+	for i := range shards {
+		start := i * set.Len() / shardCount
+		end := (i + 1) * set.Len() / shardCount
+		wg.Add(1)
+		go func(i int, shard sgd.SampleSet) {
+			defer wg.Done()
+			shards[i] = p.Workers[i].Gradient(shard)
+		}(i, set.Subset(start, end))
+	}
+	wg.Wait()
+
+	for param, vec := range p.result {
+		for i := range vec {
+			vec[i] = 0
+		}
+		for _, shard := range shards {
+			if shardVec, ok := shard[param]; ok {
+				for i, x := range shardVec {
+					vec[i] += x
+				}
+			}
+		}
+	}
+	return p.result
+}
@@ -0,0 +1,81 @@
+package mnistdemo
+
+import (
+	"math/rand"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/weakai/neuralnet"
+)
+
+func TestNeuralNetSeedDeterministic(t *testing.T) {
+	gen := rand.New(rand.NewSource(1))
+	var data []*TrainingSample
+	for i := 0; i < 40; i++ {
+		s := new(Sample)
+		for j := range s {
+			s[j] = gen.Float64()
+		}
+		data = append(data, &TrainingSample{Sample: s, Label: i % 10})
+	}
+
+	var params [2][]linalg.Vector
+	for i := range params {
+		config := DefaultTrainConfig()
+		config.Epochs = 2
+		config.BatchSize = 10
+		config.Workers = 2
+		config.Seed = 1337
+		net := NewSmallNeuralNet()
+		net.Config = config
+		net.Train(data, data[:10])
+		for _, p := range net.Parameters() {
+			params[i] = append(params[i], append(linalg.Vector{}, p.Vector...))
+		}
+	}
+
+	if len(params[0]) != len(params[1]) {
+		t.Fatalf("parameter counts differ: %d and %d", len(params[0]), len(params[1]))
+	}
+	for i, p := range params[0] {
+		for j, x := range p {
+			if y := params[1][i][j]; x != y {
+				t.Fatalf("parameter %d[%d] differs: %v and %v", i, j, x, y)
+			}
+		}
+	}
+}
+
+// BenchmarkNeuralNetGradient times minibatch
+// gradients for each worker count, so the speedup is
+// the ratio between the sub-benchmarks.
+func BenchmarkNeuralNetGradient(b *testing.B) {
+	const batchSize = 50
+	gen := rand.New(rand.NewSource(1))
+	var inputs, outputs []linalg.Vector
+	for i := 0; i < batchSize; i++ {
+		in := make(linalg.Vector, 28*28)
+		for j := range in {
+			in[j] = gen.Float64()
+		}
+		out := make(linalg.Vector, 10)
+		out[gen.Intn(10)] = 1
+		inputs = append(inputs, in)
+		outputs = append(outputs, out)
+	}
+	batch := neuralnet.VectorSampleSet(inputs, outputs)
+
+	net := NewNeuralNet()
+	for workers := 1; workers <= runtime.GOMAXPROCS(0); workers *= 2 {
+		b.Run("Workers"+strconv.Itoa(workers), func(b *testing.B) {
+			g := net.Gradienter(workers)
+			g.Gradient(batch)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				g.Gradient(batch)
+			}
+		})
+	}
+}
@@ -0,0 +1,434 @@
+package mnistdemo
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/sgd"
+	"github.com/unixpickle/weakai/neuralnet"
+)
+
+// Optimizers supported by TrainConfig.
+const (
+	OptimizerSGD      = "sgd"
+	OptimizerMomentum = "momentum"
+	OptimizerNesterov = "nesterov"
+	OptimizerRMSProp  = "rmsprop"
+	OptimizerAdam     = "adam"
+)
+
+// Learning rate schedules supported by TrainConfig.
+const (
+	ScheduleConstant = "constant"
+	ScheduleStep     = "step"
+	ScheduleCosine   = "cosine"
+	SchedulePlateau  = "plateau"
+)
+
+// TrainConfig configures gradient-based training
+// for NeuralNet and RBFNet.
+// Zero fields take the values from
+// DefaultTrainConfig, except for the decay rates,
+// which may be zero and take the defaults when nil.
+type TrainConfig struct {
+	Optimizer string
+	StepSize  float64
+	BatchSize int
+
+	// Momentum is the velocity decay for the momentum
+	// and Nesterov optimizers.
+	Momentum *float64 `json:",omitempty"`
+
+	// Decay1 and Decay2 are the moment decay rates for
+	// Adam; RMSProp uses Decay1 alone.
+	Decay1 *float64 `json:",omitempty"`
+	Decay2 *float64 `json:",omitempty"`
+
+	// WeightDecay is the coefficient of an L2 penalty
+	// on all parameters.
+	WeightDecay float64
+
+	Schedule string
+
+	// Epochs is the number of epochs to train for.
+	// If it is 0, training runs until interrupted.
+	// The cosine schedule requires it.
+	Epochs int
+
+	// WarmupEpochs linearly ramps up the step size at
+	// the start of training.
+	WarmupEpochs int
+
+	// DecayEvery and DecayFactor configure the step
+	// schedule, which multiplies the step size by
+	// DecayFactor every DecayEvery epochs.
+	// The plateau schedule also uses DecayFactor.
+	DecayEvery  int
+	DecayFactor float64
+
+	// Patience is the number of epochs without a
+	// validation improvement before the plateau
+	// schedule decays the step size.
+	Patience int
+
+	// Workers is the number of goroutines computing
+	// each NeuralNet minibatch gradient.
+	// It defaults to GOMAXPROCS.
+	Workers int
+
+	// Seed, if non-zero, seeds the generators which
+	// initialize a newly constructed NeuralNet and
+	// order its minibatches, making training
+	// reproducible for a fixed number of workers.
+	// Networks which were loaded or already trained
+	// keep their weights.
+	Seed int64
+
+	// Augmentation, if set, is a comma-separated list
+	// of Augmenters which perturb every minibatch.
+	// It is seeded with Seed when that is set.
+	Augmentation string `json:",omitempty"`
+}
+
+// DefaultTrainConfig returns the configuration used
+// when none is specified.
+func DefaultTrainConfig() *TrainConfig {
+	return &TrainConfig{
+		Optimizer:   OptimizerAdam,
+		StepSize:    0.001,
+		BatchSize:   50,
+		Momentum:    floatPtr(0.9),
+		Decay1:      floatPtr(0.9),
+		Decay2:      floatPtr(0.999),
+		Schedule:    ScheduleConstant,
+		DecayEvery:  5,
+		DecayFactor: 0.5,
+		Patience:    2,
+	}
+}
+
+// withDefaults returns a copy of the config with
+// zero fields replaced by defaults.
+func (t *TrainConfig) withDefaults() *TrainConfig {
+	def := DefaultTrainConfig()
+	if t == nil {
+		return def
+	}
+	res := *t
+	if res.Optimizer == "" {
+		res.Optimizer = def.Optimizer
+	}
+	if res.StepSize == 0 {
+		res.StepSize = def.StepSize
+	}
+	if res.BatchSize == 0 {
+		res.BatchSize = def.BatchSize
+	}
+	if res.Momentum == nil {
+		res.Momentum = def.Momentum
+	}
+	if res.Decay1 == nil {
+		res.Decay1 = def.Decay1
+	}
+	if res.Decay2 == nil {
+		res.Decay2 = def.Decay2
+	}
+	if res.Schedule == "" {
+		res.Schedule = def.Schedule
+	}
+	if res.DecayEvery == 0 {
+		res.DecayEvery = def.DecayEvery
+	}
+	if res.DecayFactor == 0 {
+		res.DecayFactor = def.DecayFactor
+	}
+	if res.Patience == 0 {
+		res.Patience = def.Patience
+	}
+	if res.Workers == 0 {
+		res.Workers = parallelism()
+	}
+	return &res
+}
+
+func floatPtr(x float64) *float64 {
+	return &x
+}
+
+// TrainMetadata records how a model was trained.
+type TrainMetadata struct {
+	Config *TrainConfig
+
+	// Scores stores the validation accuracy at the
+	// start of every epoch.
+	Scores []float64
+
+	// StepSizes stores the effective step size of
+	// every epoch.
+	StepSizes []float64
+}
+
+// trainGradient trains the parameters of a learner
+// with SGD until it is interrupted or the configured
+// number of epochs have passed.
+// The score function should return the current
+// validation accuracy.
+func trainGradient(config *TrainConfig, base sgd.Gradienter, learner sgd.Learner,
+	samples sgd.SampleSet, score func() float64) *TrainMetadata {
+	config = config.withDefaults()
+	meta := &TrainMetadata{Config: config}
+
+	var g sgd.Gradienter = base
+	if config.Augmentation != "" {
+		aug, err := ParseAugmenter(config.Augmentation)
+		if err != nil {
+			panic(err)
+		}
+		seed := config.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		g = &augmentGradienter{
+			Gradienter: g,
+			Augmenter:  aug,
+			Gen:        rand.New(rand.NewSource(seed)),
+		}
+	}
+	if config.WeightDecay != 0 {
+		g = &weightDecayGradienter{
+			Gradienter: g,
+			Params:     learner.Parameters(),
+			Decay:      config.WeightDecay,
+		}
+	}
+	switch config.Optimizer {
+	case OptimizerSGD:
+	case OptimizerMomentum, OptimizerNesterov:
+		g = &momentumGradienter{
+			Gradienter: g,
+			Momentum:   *config.Momentum,
+			Nesterov:   config.Optimizer == OptimizerNesterov,
+		}
+	case OptimizerRMSProp:
+		g = &sgd.RMSProp{Gradienter: g, Resiliency: *config.Decay1}
+	case OptimizerAdam:
+		g = &sgd.Adam{
+			Gradienter: g,
+			DecayRate1: *config.Decay1,
+			DecayRate2: *config.Decay2,
+		}
+	default:
+		panic("unknown optimizer: " + config.Optimizer)
+	}
+	scaled := &scaledGradienter{Gradienter: g, Scale: 1}
+
+	var ordered *seededSampleSet
+	if config.Seed != 0 {
+		ordered = newSeededSampleSet(samples, rand.New(rand.NewSource(config.Seed)))
+		samples = ordered
+	}
+
+	sched := &stepSchedule{Config: config, BestScore: math.Inf(-1)}
+	sgd.SGDInteractive(scaled, samples, config.StepSize, config.BatchSize, func() bool {
+		s := score()
+		log.Println("Mid-training score:", s)
+		meta.Scores = append(meta.Scores, s)
+		epoch := len(meta.Scores) - 1
+		if config.Epochs != 0 && epoch >= config.Epochs {
+			return false
+		}
+		scaled.Scale = sched.Factor(epoch, s)
+		meta.StepSizes = append(meta.StepSizes, scaled.Scale*config.StepSize)
+		if ordered != nil {
+			ordered.Shuffle()
+		}
+		return true
+	})
+	return meta
+}
+
+// seededSampleSet presents samples in an order drawn
+// from its own generator, since sgd shuffles with the
+// global one.
+// Swap does nothing, so sgd's shuffling is ignored,
+// and copies share their order with the original.
+type seededSampleSet struct {
+	Samples sgd.SampleSet
+	Order   []int
+	Gen     *rand.Rand
+}
+
+func newSeededSampleSet(samples sgd.SampleSet, gen *rand.Rand) *seededSampleSet {
+	order := make([]int, samples.Len())
+	for i := range order {
+		order[i] = i
+	}
+	return &seededSampleSet{Samples: samples, Order: order, Gen: gen}
+}
+
+// Shuffle randomly permutes the samples.
+func (s *seededSampleSet) Shuffle() {
+	s.Gen.Shuffle(len(s.Order), func(i, j int) {
+		s.Order[i], s.Order[j] = s.Order[j], s.Order[i]
+	})
+}
+
+func (s *seededSampleSet) Len() int {
+	return len(s.Order)
+}
+
+func (s *seededSampleSet) Swap(i, j int) {
+}
+
+func (s *seededSampleSet) GetSample(i int) interface{} {
+	return s.Samples.GetSample(s.Order[i])
+}
+
+func (s *seededSampleSet) Copy() sgd.SampleSet {
+	return s
+}
+
+func (s *seededSampleSet) Subset(start, end int) sgd.SampleSet {
+	return &seededSampleSet{Samples: s.Samples, Order: s.Order[start:end], Gen: s.Gen}
+}
+
+// stepSchedule computes the step size multiplier
+// for each epoch.
+type stepSchedule struct {
+	Config *TrainConfig
+
+	BestScore   float64
+	BadEpochs   int
+	PlateauRate float64
+}
+
+func (s *stepSchedule) Factor(epoch int, score float64) float64 {
+	c := s.Config
+	factor := 1.0
+	switch c.Schedule {
+	case ScheduleConstant:
+	case ScheduleStep:
+		factor = math.Pow(c.DecayFactor, float64(epoch/c.DecayEvery))
+	case ScheduleCosine:
+		if c.Epochs == 0 {
+			panic("cosine schedule requires a fixed number of epochs")
+		}
+		factor = 0.5 * (1 + math.Cos(math.Pi*float64(epoch)/float64(c.Epochs)))
+	case SchedulePlateau:
+		if s.PlateauRate == 0 {
+			s.PlateauRate = 1
+		}
+		if score > s.BestScore {
+			s.BestScore = score
+			s.BadEpochs = 0
+		} else if s.BadEpochs++; s.BadEpochs > c.Patience {
+			s.PlateauRate *= c.DecayFactor
+			s.BadEpochs = 0
+			log.Println("Validation plateaued; decaying step size.")
+		}
+		factor = s.PlateauRate
+	default:
+		panic("unknown schedule: " + c.Schedule)
+	}
+	if epoch < c.WarmupEpochs {
+		factor *= float64(epoch+1) / float64(c.WarmupEpochs+1)
+	}
+	return factor
+}
+
+// scaledGradienter multiplies the gradients from
+// another Gradienter by an adjustable factor, which
+// has the effect of scaling the step size.
+type scaledGradienter struct {
+	sgd.Gradienter
+	Scale float64
+}
+
+func (s *scaledGradienter) Gradient(set sgd.SampleSet) autofunc.Gradient {
+	grad := s.Gradienter.Gradient(set)
+	for _, vec := range grad {
+		for i := range vec {
+			vec[i] *= s.Scale
+		}
+	}
+	return grad
+}
+
+// augmentGradienter augments the inputs of each
+// minibatch before computing its gradient.
+type augmentGradienter struct {
+	Gradienter sgd.Gradienter
+	Augmenter  Augmenter
+	Gen        *rand.Rand
+}
+
+func (a *augmentGradienter) Gradient(set sgd.SampleSet) autofunc.Gradient {
+	var inputs, outputs []linalg.Vector
+	for i := 0; i < set.Len(); i++ {
+		sample := set.GetSample(i).(neuralnet.VectorSample)
+		var s Sample
+		copy(s[:], sample.Input)
+		inputs = append(inputs, a.Augmenter.Augment(&s, a.Gen)[:])
+		outputs = append(outputs, sample.Output)
+	}
+	return a.Gradienter.Gradient(neuralnet.VectorSampleSet(inputs, outputs))
+}
+
+// weightDecayGradienter adds the gradient of an L2
+// penalty to the gradients from another Gradienter.
+type weightDecayGradienter struct {
+	sgd.Gradienter
+	Params []*autofunc.Variable
+	Decay  float64
+}
+
+func (w *weightDecayGradienter) Gradient(set sgd.SampleSet) autofunc.Gradient {
+	grad := w.Gradienter.Gradient(set)
+	for _, param := range w.Params {
+		vec, ok := grad[param]
+		if !ok {
+			continue
+		}
+		for i, x := range param.Vector {
+			vec[i] += w.Decay * x
+		}
+	}
+	return grad
+}
+
+// momentumGradienter implements classical and
+// Nesterov momentum.
+type momentumGradienter struct {
+	sgd.Gradienter
+	Momentum float64
+	Nesterov bool
+
+	velocity map[*autofunc.Variable]linalg.Vector
+}
+
+func (m *momentumGradienter) Gradient(set sgd.SampleSet) autofunc.Gradient {
+	grad := m.Gradienter.Gradient(set)
+	if m.velocity == nil {
+		m.velocity = map[*autofunc.Variable]linalg.Vector{}
+	}
+	for variable, vec := range grad {
+		velocity, ok := m.velocity[variable]
+		if !ok {
+			velocity = make(linalg.Vector, len(vec))
+			m.velocity[variable] = velocity
+		}
+		for i, x := range vec {
+			velocity[i] = m.Momentum*velocity[i] + x
+			if m.Nesterov {
+				vec[i] = x + m.Momentum*velocity[i]
+			} else {
+				vec[i] = velocity[i]
+			}
+		}
+	}
+	return grad
+}
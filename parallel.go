@@ -0,0 +1,52 @@
+package mnistdemo
+
+import (
+	"runtime"
+	"sync"
+)
+
+// parallelism returns the number of goroutines to
+// use for CPU-bound work.
+func parallelism() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+// parallelFor calls f for every integer in [0, n),
+// spreading the calls across parallelism()
+// goroutines.
+func parallelFor(n int, f func(i int)) {
+	indices := make(chan int, n)
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indices {
+				f(idx)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// parallelChunks splits [0, n) into one contiguous
+// range per goroutine and calls f for every non-empty
+// range.
+func parallelChunks(n int, f func(start, end int)) {
+	chunkSize := (n + parallelism() - 1) / parallelism()
+	parallelFor(parallelism(), func(chunk int) {
+		start := chunk * chunkSize
+		end := start + chunkSize
+		if end > n {
+			end = n
+		}
+		if start < end {
+			f(start, end)
+		}
+	})
+}
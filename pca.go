@@ -0,0 +1,309 @@
+package mnistdemo
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"sync"
+
+	"github.com/unixpickle/approb"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/num-analysis/linalg/qrdecomp"
+	"github.com/unixpickle/serializer"
+)
+
+const (
+	pcaSerializerID    = "github.com/unixpickle/mnistdemo.PCA"
+	pcaDefaultMaxIters = 1000
+	pcaDefaultTol      = 1e-6
+	pcaMaxComponents   = 200
+)
+
+func init() {
+	serializer.RegisterTypedDeserializer(pcaSerializerID, DeserializePCA)
+}
+
+// PCAConfig controls how a PCA is fit.
+type PCAConfig struct {
+	// SampleCount is the number of random samples used
+	// to estimate the covariance matrix.
+	// If it is 0, the exact covariance is computed
+	// from every sample.
+	SampleCount int
+
+	// Components is the number of principal
+	// components to keep.
+	// It is ignored if TargetVariance is non-zero.
+	Components int
+
+	// TargetVariance, if non-zero, is the fraction of
+	// the total variance (between 0 and 1) that the
+	// kept components should explain.
+	// The fewest components reaching this fraction are
+	// kept, up to a maximum of 200.
+	TargetVariance float64
+
+	// Tolerance is the largest relative change in any
+	// eigenvalue estimate at which power iteration is
+	// considered to have converged.
+	// It defaults to 1e-6.
+	Tolerance float64
+
+	// MaxIterations bounds the number of power
+	// iterations, defaulting to 1000.
+	MaxIterations int
+}
+
+// A PCA projects vectors onto their principal
+// components.
+type PCA struct {
+	Mean linalg.Vector
+
+	// Components stores one unit-length principal
+	// component per row, sorted by decreasing
+	// variance.
+	Components *linalg.Matrix
+
+	// Variances stores the variance along each
+	// principal component.
+	Variances []float64
+
+	// TotalVariance is the trace of the covariance
+	// matrix, i.e. the sum of all eigenvalues
+	// including those that were discarded.
+	TotalVariance float64
+}
+
+// DeserializePCA deserializes a PCA that was
+// serialized with PCA.Serialize().
+func DeserializePCA(d []byte) (*PCA, error) {
+	var res PCA
+	data, err := decompress(d)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// FitPCA computes the principal components of a set
+// of equal-length vectors.
+func FitPCA(data []linalg.Vector, config *PCAConfig) *PCA {
+	dim := len(data[0])
+	var mean linalg.Vector
+	var cov *linalg.Matrix
+	if config.SampleCount == 0 {
+		mean, cov = exactCovariance(data)
+	} else {
+		mean = vectorMean(data)
+		cov = approb.Covariances(config.SampleCount, func() linalg.Vector {
+			return data[rand.Intn(len(data))]
+		})
+	}
+
+	var trace float64
+	for i := 0; i < dim; i++ {
+		trace += cov.Data[i*dim+i]
+	}
+
+	count := config.Components
+	if config.TargetVariance != 0 {
+		count = pcaMaxComponents
+	}
+	if count > dim {
+		count = dim
+	}
+	tol := config.Tolerance
+	if tol == 0 {
+		tol = pcaDefaultTol
+	}
+	maxIters := config.MaxIterations
+	if maxIters == 0 {
+		maxIters = pcaDefaultMaxIters
+	}
+	vals, vecs := largestEigenvectors(cov, count, tol, maxIters)
+
+	if config.TargetVariance != 0 {
+		var explained float64
+		for i, val := range vals {
+			explained += val
+			if explained >= config.TargetVariance*trace {
+				vals, vecs = vals[:i+1], vecs[:i+1]
+				break
+			}
+		}
+	}
+
+	res := &PCA{
+		Mean:          mean,
+		Components:    linalg.NewMatrix(len(vecs), dim),
+		Variances:     vals,
+		TotalVariance: trace,
+	}
+	for i, vec := range vecs {
+		copy(res.Components.Data[i*dim:(i+1)*dim], vec)
+	}
+	return res
+}
+
+// Transform projects a vector onto the principal
+// components.
+func (p *PCA) Transform(v linalg.Vector) linalg.Vector {
+	res := make(linalg.Vector, p.Components.Rows)
+	dim := p.Components.Cols
+	for i := range res {
+		row := p.Components.Data[i*dim : (i+1)*dim]
+		var sum float64
+		for j, x := range v {
+			sum += row[j] * (x - p.Mean[j])
+		}
+		res[i] = sum
+	}
+	return res
+}
+
+// InverseTransform maps projected coordinates back
+// into the original space.
+func (p *PCA) InverseTransform(v linalg.Vector) linalg.Vector {
+	dim := p.Components.Cols
+	res := make(linalg.Vector, dim)
+	copy(res, p.Mean)
+	for i, x := range v {
+		row := p.Components.Data[i*dim : (i+1)*dim]
+		for j, y := range row {
+			res[j] += x * y
+		}
+	}
+	return res
+}
+
+// ExplainedVariance returns the fraction of the
+// total variance explained by each kept component.
+func (p *PCA) ExplainedVariance() []float64 {
+	res := make([]float64, len(p.Variances))
+	for i, v := range p.Variances {
+		res[i] = v / p.TotalVariance
+	}
+	return res
+}
+
+// SerializerType returns the unique ID used to
+// serialize PCAs.
+func (p *PCA) SerializerType() string {
+	return pcaSerializerID
+}
+
+// Serialize serializes the PCA.
+func (p *PCA) Serialize() ([]byte, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return compress(data), nil
+}
+
+func trainingVectors(data []*TrainingSample) []linalg.Vector {
+	res := make([]linalg.Vector, len(data))
+	for i, x := range data {
+		res[i] = x.Sample[:]
+	}
+	return res
+}
+
+func vectorMean(data []linalg.Vector) linalg.Vector {
+	res := make(linalg.Vector, len(data[0]))
+	for _, v := range data {
+		for i, x := range v {
+			res[i] += x
+		}
+	}
+	for i := range res {
+		res[i] /= float64(len(data))
+	}
+	return res
+}
+
+// exactCovariance computes the mean and covariance
+// of every vector.
+// Second moments are accumulated over each vector's
+// non-zero entries in parallel, which is fast for
+// sparse images.
+func exactCovariance(data []linalg.Vector) (linalg.Vector, *linalg.Matrix) {
+	dim := len(data[0])
+	mean := vectorMean(data)
+
+	var lock sync.Mutex
+	moments := make([]float64, dim*dim)
+	parallelChunks(len(data), func(start, end int) {
+		local := make([]float64, dim*dim)
+		var nonzero []int
+		for _, v := range data[start:end] {
+			nonzero = nonzero[:0]
+			for i, x := range v {
+				if x != 0 {
+					nonzero = append(nonzero, i)
+				}
+			}
+			for _, i := range nonzero {
+				row := local[i*dim:]
+				for _, j := range nonzero {
+					row[j] += v[i] * v[j]
+				}
+			}
+		}
+		lock.Lock()
+		for i, x := range local {
+			moments[i] += x
+		}
+		lock.Unlock()
+	})
+
+	cov := linalg.NewMatrix(dim, dim)
+	n := float64(len(data))
+	for i := 0; i < dim; i++ {
+		for j := 0; j < dim; j++ {
+			cov.Data[i*dim+j] = moments[i*dim+j]/n - mean[i]*mean[j]
+		}
+	}
+	return mean, cov
+}
+
+// largestEigenvectors runs orthogonal (subspace)
+// iteration to find the count largest eigenvalues
+// and unit eigenvectors of a symmetric matrix.
+// It stops once no eigenvalue estimate changes by
+// more than tol (relative) between iterations.
+func largestEigenvectors(mat *linalg.Matrix, count int, tol float64,
+	maxIters int) (vals []float64, vecs []linalg.Vector) {
+	vecMat := linalg.NewMatrix(mat.Rows, count)
+	for i := range vecMat.Data {
+		vecMat.Data[i] = rand.NormFloat64()
+	}
+	vecMat, _ = qrdecomp.Householder(vecMat)
+
+	lastVals := make([]float64, count)
+	for iter := 0; iter < maxIters; iter++ {
+		product := mat.MulFast(vecMat)
+		converged := true
+		for i := 0; i < count; i++ {
+			val := product.Col(i).Dot(vecMat.Col(i))
+			if math.Abs(val-lastVals[i]) > tol*math.Abs(val) {
+				converged = false
+			}
+			lastVals[i] = val
+		}
+		vecMat, _ = qrdecomp.Householder(product)
+		if converged {
+			break
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		col := vecMat.Col(i)
+		vals = append(vals, mat.MulFast(linalg.NewMatrixColumn(col)).Col(0).Dot(col))
+		vecs = append(vecs, col)
+	}
+	return
+}
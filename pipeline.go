@@ -0,0 +1,151 @@
+package mnistdemo
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/unixpickle/serializer"
+)
+
+const (
+	pipelineSerializerID = "github.com/unixpickle/mnistdemo.Pipeline"
+
+	pipelineDefaultInner = "softmax"
+)
+
+func init() {
+	serializer.RegisterTypedDeserializer(pipelineSerializerID, DeserializePipeline)
+}
+
+// A Pipeline preprocesses samples with a chain of
+// transformers before passing them to another
+// classifier.
+//
+// Stages names the transformers in Transformers and
+// Inner names the model in Classifiers, defaulting to
+// "softmax".
+// If Transformers or Model are set before training,
+// they are used instead of Stages or Inner.
+// The transformers are fit in order during training,
+// each on the output of the ones before it.
+//
+// There is no HOG stage, since HOG descriptors are
+// not images; to classify them, set the Features of
+// the inner model instead.
+type Pipeline struct {
+	Stages []string
+	Inner  string
+
+	Transformers []Transformer
+	Model        Classifier
+}
+
+// pipelineArchive is the serialized form of a
+// Pipeline, with each transformer and the model
+// serialized with its type.
+type pipelineArchive struct {
+	Stages       []string
+	Inner        string
+	Transformers [][]byte
+	Model        []byte
+}
+
+// DeserializePipeline deserializes a Pipeline that
+// was serialized with Pipeline.Serialize().
+func DeserializePipeline(d []byte) (*Pipeline, error) {
+	data, err := decompress(d)
+	if err != nil {
+		return nil, err
+	}
+	var archive pipelineArchive
+	if err := json.Unmarshal(data, &archive); err != nil {
+		return nil, err
+	}
+	res := &Pipeline{Stages: archive.Stages, Inner: archive.Inner}
+	for _, transformerData := range archive.Transformers {
+		t, err := deserializeTransformer(transformerData)
+		if err != nil {
+			return nil, err
+		}
+		res.Transformers = append(res.Transformers, t)
+	}
+	res.Model, err = deserializeClassifier(archive.Model)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Train fits the transformers and trains the model
+// on the transformed samples.
+func (p *Pipeline) Train(data, validation []*TrainingSample) {
+	if p.Transformers == nil {
+		for _, name := range p.Stages {
+			desc, ok := Transformers[name]
+			if !ok {
+				panic("unknown transformer: " + name)
+			}
+			p.Transformers = append(p.Transformers, desc.Construct())
+		}
+	}
+	for i, t := range p.Transformers {
+		log.Printf("Fitting transformer %d (%T)...", i+1, t)
+		t.Fit(data)
+		data = transformSamples(t, data)
+		validation = transformSamples(t, validation)
+	}
+
+	if p.Model == nil {
+		p.Model = constructClassifier(p.Inner, pipelineDefaultInner)
+	}
+	// The model reports its own validation accuracy,
+	// which is that of the whole pipeline.
+	log.Println("Training model...")
+	p.Model.Train(data, validation)
+}
+
+// Classify transforms the sample and classifies the
+// result.
+func (p *Pipeline) Classify(s *Sample) int {
+	return p.Model.Classify(p.Transform(s))
+}
+
+// Transform applies every transformer in order.
+func (p *Pipeline) Transform(s *Sample) *Sample {
+	for _, t := range p.Transformers {
+		s = t.Transform(s)
+	}
+	return s
+}
+
+// SerializerType returns the unique ID used to
+// serialize Pipelines.
+func (p *Pipeline) SerializerType() string {
+	return pipelineSerializerID
+}
+
+// Serialize serializes the transformers along with
+// the model.
+func (p *Pipeline) Serialize() ([]byte, error) {
+	archive := &pipelineArchive{
+		Stages: p.Stages,
+		Inner:  p.Inner,
+	}
+	for _, t := range p.Transformers {
+		transformerData, err := serializer.SerializeWithType(t)
+		if err != nil {
+			return nil, err
+		}
+		archive.Transformers = append(archive.Transformers, transformerData)
+	}
+	var err error
+	archive.Model, err = serializer.SerializeWithType(p.Model)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(archive)
+	if err != nil {
+		return nil, err
+	}
+	return compress(data), nil
+}
@@ -0,0 +1,177 @@
+package mnistdemo
+
+import (
+	"encoding/json"
+	"image"
+	"log"
+	"math"
+
+	"github.com/unixpickle/serializer"
+)
+
+const (
+	pixelBayesSerializerID = "github.com/unixpickle/mnistdemo.PixelBayes"
+	pixelBayesSmoothing    = 1
+	pixelBayesBinarize     = 0.5
+)
+
+func init() {
+	serializer.RegisterTypedDeserializer(pixelBayesSerializerID, DeserializePixelBayes)
+}
+
+// PixelBayes is a naive Bayes classifier which works
+// directly on raw pixels.
+//
+// If Multinomial is false, pixels are binarized and
+// each class stores the probability that each pixel
+// is on (Bernoulli naive Bayes).
+// Otherwise, intensities are treated as fractional
+// counts and each class stores a distribution over
+// pixels (multinomial naive Bayes).
+type PixelBayes struct {
+	Multinomial bool
+
+	LogPriors [10]float64
+	Probs     [10][]float64
+
+	logProbs    [10][]float64
+	logNotProbs [10][]float64
+}
+
+// DeserializePixelBayes deserializes a PixelBayes
+// that was serialized with PixelBayes.Serialize().
+func DeserializePixelBayes(d []byte) (*PixelBayes, error) {
+	var res PixelBayes
+	data, err := decompress(d)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	res.computeLogs()
+	return &res, nil
+}
+
+// Train counts pixels for each class, using
+// Laplace smoothing.
+func (p *PixelBayes) Train(data, validation []*TrainingSample) {
+	log.Println("Counting pixels...")
+	var counts [10]float64
+	var pixelCounts [10][28 * 28]float64
+	for _, x := range data {
+		if p.Multinomial {
+			counts[x.Label] += x.Sample.sum()
+			for i, v := range x.Sample {
+				pixelCounts[x.Label][i] += v
+			}
+		} else {
+			counts[x.Label]++
+			for i, v := range x.Sample {
+				if v > pixelBayesBinarize {
+					pixelCounts[x.Label][i]++
+				}
+			}
+		}
+	}
+
+	var classCounts [10]int
+	for _, x := range data {
+		classCounts[x.Label]++
+	}
+	for class := range p.Probs {
+		p.LogPriors[class] = logPrior(classCounts[class], len(data))
+		p.Probs[class] = make([]float64, 28*28)
+		denom := counts[class] + 2*pixelBayesSmoothing
+		if p.Multinomial {
+			denom = counts[class] + 28*28*pixelBayesSmoothing
+		}
+		for i, c := range pixelCounts[class] {
+			p.Probs[class][i] = (c + pixelBayesSmoothing) / denom
+		}
+	}
+	p.computeLogs()
+
+	log.Println("Running cross validation...")
+	var correct int
+	for _, s := range validation {
+		if p.Classify(s.Sample) == s.Label {
+			correct++
+		}
+	}
+	log.Printf("Got %d/%d", correct, len(validation))
+}
+
+// Classify returns the class with the highest
+// posterior probability.
+func (p *PixelBayes) Classify(s *Sample) int {
+	scores := p.Scores(s)
+	return maxIndex(scores[:])
+}
+
+// Scores computes the log posterior of each class,
+// up to a constant.
+func (p *PixelBayes) Scores(s *Sample) [10]float64 {
+	var res [10]float64
+	for class := range p.Probs {
+		if p.LogPriors[class] == absentLogPrior {
+			res[class] = math.Inf(-1)
+			continue
+		}
+		logProb := p.LogPriors[class]
+		for i, v := range s {
+			if p.Multinomial {
+				logProb += v * p.logProbs[class][i]
+			} else if v > pixelBayesBinarize {
+				logProb += p.logProbs[class][i]
+			} else {
+				logProb += p.logNotProbs[class][i]
+			}
+		}
+		res[class] = logProb
+	}
+	return res
+}
+
+// RenderImages renders each class's pixel
+// probabilities, darkest where a pixel is most
+// likely to be on.
+// Multinomial maps are normalized so that the most
+// likely pixel of each class is black.
+func (p *PixelBayes) RenderImages() []image.Image {
+	var res []image.Image
+	for _, probs := range p.Probs {
+		max := 1.0
+		if p.Multinomial {
+			max = maxValue(probs)
+		}
+		res = append(res, vectorImage(probs, 0, max))
+	}
+	return res
+}
+
+// SerializerType returns the unique ID used to
+// serialize PixelBayes models.
+func (p *PixelBayes) SerializerType() string {
+	return pixelBayesSerializerID
+}
+
+// Serialize serializes the model's probabilities.
+func (p *PixelBayes) Serialize() ([]byte, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return compress(data), nil
+}
+
+func (p *PixelBayes) computeLogs() {
+	for class, probs := range p.Probs {
+		p.logProbs[class] = make([]float64, len(probs))
+		p.logNotProbs[class] = make([]float64, len(probs))
+		for i, prob := range probs {
+			p.logProbs[class][i] = math.Log(prob)
+			p.logNotProbs[class][i] = math.Log(1 - prob)
+		}
+	}
+}
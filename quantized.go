@@ -0,0 +1,258 @@
+package mnistdemo
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/serializer"
+)
+
+const quantizedNetSerializerID = "github.com/unixpickle/mnistdemo.QuantizedNet"
+
+func init() {
+	serializer.RegisterTypedDeserializer(quantizedNetSerializerID, DeserializeQuantizedNet)
+}
+
+// A networkModel is a classifier backed by a network
+// with trainable parameters.
+type networkModel interface {
+	Classifier
+	Parameters() []*autofunc.Variable
+	compile()
+}
+
+// A QuantizedNet wraps a NeuralNet or RBFNet whose
+// parameters are pruned and quantized when it is
+// serialized, making it much smaller to download.
+//
+// Model always holds the dequantized parameters, so
+// it classifies exactly like a deserialized copy.
+type QuantizedNet struct {
+	Bits          int
+	PruneFraction float64
+	Model         networkModel
+}
+
+// quantizedArchive is the serialized form of a
+// QuantizedNet.
+// Skeleton is the wrapped model with all of its
+// parameters set to zero.
+type quantizedArchive struct {
+	Bits          int
+	PruneFraction float64
+	Skeleton      []byte
+	Params        []*quantizedParam
+}
+
+// quantizedParam stores one parameter vector as
+// signed integers (one byte each for 8 bits, two
+// little-endian bytes for 16 bits) which are
+// multiplied by Scale to recover the values.
+type quantizedParam struct {
+	Scale  float64
+	Values []byte
+}
+
+// QuantizeNet prunes the smallest pruneFraction of
+// each parameter vector and then quantizes it to 8
+// or 16 bits.
+// The model is modified in place.
+func QuantizeNet(model Classifier, bits int, pruneFraction float64) (*QuantizedNet, error) {
+	if bits != 8 && bits != 16 {
+		return nil, fmt.Errorf("unsupported bit depth: %d", bits)
+	}
+	if pruneFraction < 0 || pruneFraction > 1 {
+		return nil, fmt.Errorf("prune fraction must be between 0 and 1: %f", pruneFraction)
+	}
+	netModel, ok := model.(networkModel)
+	if !ok {
+		return nil, fmt.Errorf("cannot quantize %T", model)
+	}
+	res := &QuantizedNet{
+		Bits:          bits,
+		PruneFraction: pruneFraction,
+		Model:         netModel,
+	}
+	res.quantize()
+	return res, nil
+}
+
+// DeserializeQuantizedNet deserializes a
+// QuantizedNet and dequantizes its parameters.
+func DeserializeQuantizedNet(d []byte) (*QuantizedNet, error) {
+	dec, err := decompress(d)
+	if err != nil {
+		return nil, err
+	}
+	var archive quantizedArchive
+	if err := gob.NewDecoder(bytes.NewBuffer(dec)).Decode(&archive); err != nil {
+		return nil, err
+	}
+	skeleton, err := serializer.DeserializeWithType(archive.Skeleton)
+	if err != nil {
+		return nil, err
+	}
+	model, ok := skeleton.(networkModel)
+	if !ok {
+		return nil, fmt.Errorf("cannot quantize %T", skeleton)
+	}
+	params := model.Parameters()
+	if len(params) != len(archive.Params) {
+		return nil, errors.New("parameter count mismatch")
+	}
+	for i, param := range params {
+		if err := archive.Params[i].Decode(archive.Bits, param.Vector); err != nil {
+			return nil, err
+		}
+	}
+	model.compile()
+	return &QuantizedNet{
+		Bits:          archive.Bits,
+		PruneFraction: archive.PruneFraction,
+		Model:         model,
+	}, nil
+}
+
+// Train trains the wrapped model and quantizes the
+// result.
+func (q *QuantizedNet) Train(data, validation []*TrainingSample) {
+	q.Model.Train(data, validation)
+	q.quantize()
+}
+
+// Classify classifies the sample with the wrapped
+// model.
+func (q *QuantizedNet) Classify(s *Sample) int {
+	return q.Model.Classify(s)
+}
+
+// SerializerType returns the unique ID used to
+// serialize QuantizedNets.
+func (q *QuantizedNet) SerializerType() string {
+	return quantizedNetSerializerID
+}
+
+// Serialize serializes the quantized parameters and
+// the structure of the wrapped model.
+func (q *QuantizedNet) Serialize() ([]byte, error) {
+	archive := &quantizedArchive{Bits: q.Bits, PruneFraction: q.PruneFraction}
+	for _, param := range q.Model.Parameters() {
+		archive.Params = append(archive.Params, encodeQuantized(q.Bits, param.Vector))
+	}
+	skeleton, err := q.skeleton()
+	if err != nil {
+		return nil, err
+	}
+	archive.Skeleton = skeleton
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(archive); err != nil {
+		return nil, err
+	}
+	return compress(buf.Bytes()), nil
+}
+
+// skeleton serializes a copy of the wrapped model
+// with every parameter set to zero.
+// The copy is made by serializing the model, so the
+// live model is never modified.
+func (q *QuantizedNet) skeleton() ([]byte, error) {
+	data, err := serializer.SerializeWithType(q.Model)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := serializer.DeserializeWithType(data)
+	if err != nil {
+		return nil, err
+	}
+	model, ok := obj.(networkModel)
+	if !ok {
+		return nil, fmt.Errorf("cannot quantize %T", obj)
+	}
+	for _, param := range model.Parameters() {
+		for i := range param.Vector {
+			param.Vector[i] = 0
+		}
+	}
+	return serializer.SerializeWithType(model)
+}
+
+// quantize prunes and quantizes every parameter of
+// the wrapped model in place.
+func (q *QuantizedNet) quantize() {
+	for _, param := range q.Model.Parameters() {
+		pruneSmallest(param.Vector, q.PruneFraction)
+		encodeQuantized(q.Bits, param.Vector).Decode(q.Bits, param.Vector)
+	}
+	q.Model.compile()
+}
+
+// pruneSmallest zeroes the given fraction of values
+// with the smallest magnitudes.
+func pruneSmallest(vec []float64, fraction float64) {
+	count := int(fraction * float64(len(vec)))
+	if count == 0 {
+		return
+	}
+	mags := make([]float64, len(vec))
+	for i, x := range vec {
+		mags[i] = math.Abs(x)
+	}
+	sort.Float64s(mags)
+	threshold := mags[count-1]
+	pruned := 0
+	for i, x := range vec {
+		if pruned < count && math.Abs(x) <= threshold {
+			vec[i] = 0
+			pruned++
+		}
+	}
+}
+
+// encodeQuantized quantizes values symmetrically,
+// so that zero (and thus every pruned value) is
+// represented exactly.
+func encodeQuantized(bits int, vec []float64) *quantizedParam {
+	maxInt := float64(int(1)<<uint(bits-1) - 1)
+	var maxAbs float64
+	for _, x := range vec {
+		maxAbs = math.Max(maxAbs, math.Abs(x))
+	}
+	res := &quantizedParam{Scale: maxAbs / maxInt}
+	if res.Scale == 0 {
+		res.Scale = 1
+	}
+	res.Values = make([]byte, len(vec)*bits/8)
+	for i, x := range vec {
+		q := int(math.Floor(x/res.Scale + 0.5))
+		if bits == 8 {
+			res.Values[i] = byte(int8(q))
+		} else {
+			res.Values[2*i] = byte(uint16(int16(q)))
+			res.Values[2*i+1] = byte(uint16(int16(q)) >> 8)
+		}
+	}
+	return res
+}
+
+// Decode writes the dequantized values to vec.
+func (q *quantizedParam) Decode(bits int, vec []float64) error {
+	if len(q.Values) != len(vec)*bits/8 {
+		return errors.New("quantized parameter has wrong size")
+	}
+	for i := range vec {
+		var x int
+		if bits == 8 {
+			x = int(int8(q.Values[i]))
+		} else {
+			x = int(int16(uint16(q.Values[2*i]) | uint16(q.Values[2*i+1])<<8))
+		}
+		vec[i] = float64(x) * q.Scale
+	}
+	return nil
+}
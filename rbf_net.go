@@ -3,8 +3,10 @@ package mnistdemo
 import (
 	"errors"
 	"log"
+	"math/rand"
 
 	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
 	"github.com/unixpickle/serializer"
 	"github.com/unixpickle/sgd"
 	"github.com/unixpickle/weakai/neuralnet"
@@ -14,14 +16,48 @@ import (
 const (
 	rbfNetSerializerID = "github.com/unixpickle/mnistdemo.RBFNet"
 	rbfNetFilterCount  = 8
+
+	rbfNetDefaultCenters      = 300
+	rbfNetDefaultLeastSquares = 10000
+	rbfNetSharedScale         = 0.05
+	rbfNetKMeansSubset        = 20000
+)
+
+// Center initialization methods for RBFNet.
+const (
+	RBFInitSamples     = "samples"
+	RBFInitKMeans      = "kmeans"
+	RBFInitClassKMeans = "class-kmeans"
 )
 
 func init() {
 	serializer.RegisterTypedDeserializer(rbfNetSerializerID, DeserializeRBFNet)
 }
 
+// An RBFNet is a radial basis function network.
+//
+// Metadata records how the network was trained.
+// The remaining fields configure training and are
+// not serialized.
+// CenterInit selects how centers are chosen (one of
+// RBFInitSamples, RBFInitKMeans, or
+// RBFInitClassKMeans), defaulting to random
+// samples with a single shared width.
+// With k-means, every center gets its own learnable
+// width, initialized from the spread of its cluster.
+// CenterCount defaults to 300 and
+// LeastSquaresSamples, the size of the subset used
+// for least-squares pre-training, defaults to 10000.
 type RBFNet struct {
-	Net *rbf.Network
+	Net      *rbf.Network
+	Metadata *TrainMetadata
+
+	Config              *TrainConfig
+	CenterCount         int
+	CenterInit          string
+	LeastSquaresSamples int
+
+	engine *inferenceEngine
 }
 
 func DeserializeRBFNet(d []byte) (*RBFNet, error) {
@@ -29,25 +65,49 @@ func DeserializeRBFNet(d []byte) (*RBFNet, error) {
 	if err != nil {
 		return nil, errors.New("failed to decompress network: " + err.Error())
 	}
-	n, err := rbf.DeserializeNetwork(dec)
+	raw, meta := unarchiveNetwork(dec)
+	n, err := rbf.DeserializeNetwork(raw)
 	if err != nil {
 		return nil, err
 	}
-	return &RBFNet{Net: n}, nil
+	res := &RBFNet{Net: n, Metadata: meta}
+	res.compile()
+	return res, nil
 }
 
 func (n *RBFNet) Train(data, validation []*TrainingSample) {
 	log.Println("Initializing network...")
 	samples := neuralnetSampleSet(data)
-	n.Net = &rbf.Network{
-		DistLayer:  rbf.NewDistLayerSamples(28*28, 300, samples),
-		ScaleLayer: rbf.NewScaleLayerShared(0.05),
-		ExpLayer:   &rbf.ExpLayer{Normalize: true},
+	centerCount := n.CenterCount
+	if centerCount == 0 {
+		centerCount = rbfNetDefaultCenters
+	}
+	n.Net = &rbf.Network{ExpLayer: &rbf.ExpLayer{Normalize: true}}
+	switch n.CenterInit {
+	case "", RBFInitSamples:
+		n.Net.DistLayer = rbf.NewDistLayerSamples(28*28, centerCount, samples)
+		n.Net.ScaleLayer = rbf.NewScaleLayerShared(rbfNetSharedScale)
+	case RBFInitKMeans, RBFInitClassKMeans:
+		log.Println("Clustering centers...")
+		centers := rbfKMeansCenters(data, centerCount, n.CenterInit == RBFInitClassKMeans)
+		n.Net.DistLayer = rbf.NewDistLayerSamples(28*28, len(centers), samples)
+		n.Net.ScaleLayer = rbf.NewScaleLayer(len(centers), rbfNetSharedScale)
+		n.setCenters(centers, trainingVectors(data))
+	default:
+		panic("unknown center initialization: " + n.CenterInit)
 	}
 
 	log.Println("Least-squares pre-training...")
+	lsCount := n.LeastSquaresSamples
+	if lsCount == 0 {
+		lsCount = rbfNetDefaultLeastSquares
+	}
+	if lsCount > samples.Len() {
+		lsCount = samples.Len()
+	}
 	sgd.ShuffleSampleSet(samples)
-	n.Net.OutLayer = rbf.LeastSquares(n.Net, samples.Subset(0, 10000), 20)
+	n.Net.OutLayer = rbf.LeastSquares(n.Net, samples.Subset(0, lsCount), 20)
+	n.compile()
 
 	log.Println("Fine-tuning with SGD...")
 
@@ -55,11 +115,10 @@ func (n *RBFNet) Train(data, validation []*TrainingSample) {
 		Learner:  n.Net,
 		CostFunc: neuralnet.MeanSquaredCost{},
 	}
-	adam := &sgd.Adam{Gradienter: gradienter}
-	sgd.SGDInteractive(adam, samples, 0.001, 50, func() bool {
-		log.Println("Mid-training score:", n.score(validation))
-		return true
+	n.Metadata = trainGradient(n.Config, gradienter, n.Net, samples, func() float64 {
+		return n.score(validation)
 	})
+	n.compile()
 
 	log.Println("Running cross validation...")
 	var correct, total int
@@ -73,10 +132,25 @@ func (n *RBFNet) Train(data, validation []*TrainingSample) {
 }
 
 func (n *RBFNet) Classify(s *Sample) int {
+	if n.engine != nil {
+		return n.engine.Classify(s[:])
+	}
+	scores := n.Scores(s)
+	return maxIndex(scores[:])
+}
+
+// Scores returns the network's outputs.
+func (n *RBFNet) Scores(s *Sample) [10]float64 {
+	var res [10]float64
+	if n.engine != nil {
+		n.engine.Apply(s[:], func(out []float64) {
+			copy(res[:], out)
+		})
+		return res
+	}
 	inVar := &autofunc.Variable{Vector: s[:]}
-	output := n.Net.Apply(inVar).Output()
-	_, idx := output.Max()
-	return idx
+	copy(res[:], n.Net.Apply(inVar).Output())
+	return res
 }
 
 func (n *RBFNet) SerializerType() string {
@@ -88,7 +162,24 @@ func (n *RBFNet) Serialize() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return compress(raw), nil
+	return archiveNetwork(raw, n.Metadata)
+}
+
+// Parameters returns the network's trainable
+// parameters.
+func (n *RBFNet) Parameters() []*autofunc.Variable {
+	return n.Net.Parameters()
+}
+
+// compile builds the fast inference path for the
+// network, falling back on autodiff if the network
+// cannot be compiled.
+func (n *RBFNet) compile() {
+	engine, err := compileRBF(n.Net, 28*28)
+	if err != nil {
+		log.Println("Using autodiff for inference:", err)
+	}
+	n.engine = engine
 }
 
 func (n *RBFNet) score(v []*TrainingSample) float64 {
@@ -101,3 +192,75 @@ func (n *RBFNet) score(v []*TrainingSample) float64 {
 	}
 	return float64(correct) / float64(total)
 }
+
+// setCenters overwrites the network's centers and
+// sets each center's scale to 1/(2*s^2), where s^2
+// is the mean squared distance from the center to
+// the data points closest to it.
+func (n *RBFNet) setCenters(centers, data []linalg.Vector) {
+	centerVec := n.Net.DistLayer.Parameters()[0].Vector
+	for i, c := range centers {
+		copy(centerVec[i*len(c):(i+1)*len(c)], c)
+	}
+
+	nearest := make([]int, len(data))
+	dists := make([]float64, len(data))
+	parallelFor(len(data), func(i int) {
+		nearest[i], dists[i] = nearestCenter(centers, data[i])
+	})
+	spreads := make([]float64, len(centers))
+	counts := make([]int, len(centers))
+	for i, idx := range nearest {
+		spreads[idx] += dists[i]
+		counts[idx]++
+	}
+	scales := n.Net.ScaleLayer.Parameters()[0].Vector
+	for i, spread := range spreads {
+		if counts[i] == 0 || spread == 0 {
+			scales[i] = rbfNetSharedScale
+		} else {
+			scales[i] = float64(counts[i]) / (2 * spread)
+		}
+	}
+}
+
+// rbfKMeansCenters clusters a random subset of the
+// data into count centers.
+// If perClass is set, each class is clustered
+// separately into an equal share of the centers.
+func rbfKMeansCenters(data []*TrainingSample, count int, perClass bool) []linalg.Vector {
+	subset := data
+	if len(subset) > rbfNetKMeansSubset {
+		subset = make([]*TrainingSample, rbfNetKMeansSubset)
+		for i, j := range rand.Perm(len(data))[:len(subset)] {
+			subset[i] = data[j]
+		}
+	}
+	if !perClass {
+		centers, _ := kMeans(trainingVectors(subset), count)
+		return centers
+	}
+
+	var res []linalg.Vector
+	for class := 0; class < 10; class++ {
+		var classData []linalg.Vector
+		for _, x := range subset {
+			if x.Label == class {
+				classData = append(classData, x.Sample[:])
+			}
+		}
+		classCount := count / 10
+		if class < count%10 {
+			classCount++
+		}
+		if classCount == 0 || len(classData) == 0 {
+			continue
+		}
+		if classCount > len(classData) {
+			classCount = len(classData)
+		}
+		centers, _ := kMeans(classData, classCount)
+		res = append(res, centers...)
+	}
+	return res
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image/png"
+	"io/ioutil"
+	"os"
+
+	"github.com/unixpickle/mnistdemo"
+	"github.com/unixpickle/serializer"
+)
+
+func main() {
+	var cols int
+	flag.IntVar(&cols, "cols", 10, "number of images per row")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <model_file> <output.png>\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Renders a model's learned templates as an image grid.")
+		fmt.Fprintln(os.Stderr)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	data, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to read model:", err)
+		os.Exit(1)
+	}
+	model, err := serializer.DeserializeWithType(data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to deserialize model:", err)
+		os.Exit(1)
+	}
+	renderer, ok := model.(mnistdemo.ImageRenderer)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Model type %T cannot be rendered.\n", model)
+		os.Exit(1)
+	}
+	if bayes, ok := model.(*mnistdemo.Bayes); ok && bayes.Features != nil {
+		fmt.Fprintln(os.Stderr, "Bayes models on extracted features cannot draw images.")
+		os.Exit(1)
+	}
+
+	f, err := os.Create(flag.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to create output:", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	grid := mnistdemo.ImageGrid(renderer.RenderImages(), cols)
+	if err := png.Encode(f, grid); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to encode image:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,452 @@
+package mnistdemo
+
+import (
+	"encoding/json"
+	"image"
+	"log"
+	"math"
+	"math/rand"
+
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+)
+
+const (
+	softmaxSerializerID = "github.com/unixpickle/mnistdemo.Softmax"
+
+	softmaxDefaultL2    = 1e-4
+	softmaxPCAFeatures  = 100
+	softmaxL1Smoothing  = 1e-6
+	softmaxLBFGSHistory = 10
+	softmaxLBFGSIters   = 200
+	softmaxGradEpsilon  = 1e-10
+	softmaxSGDEpochs    = 10
+	softmaxSGDBatch     = 100
+	softmaxSGDStep      = 0.5
+)
+
+// Optimizers for Softmax.
+const (
+	SoftmaxLBFGS = "lbfgs"
+	SoftmaxSGD   = "sgd"
+)
+
+func init() {
+	serializer.RegisterTypedDeserializer(softmaxSerializerID, DeserializeSoftmax)
+}
+
+// Softmax is a multinomial logistic regression
+// classifier.
+//
+// It works on raw pixels, or on PCAComponents
+// principal components if that is non-zero.
+//
+// L2 and L1 are regularization coefficients.
+// The L1 penalty is smoothed slightly so that it can
+// be minimized with L-BFGS.
+// Optimizer is SoftmaxLBFGS (the default) for
+// full-batch L-BFGS, or SoftmaxSGD for minibatch
+// SGD.
+// Iterations is the number of L-BFGS iterations or
+// SGD epochs.
+type Softmax struct {
+	Weights [10]linalg.Vector
+	Biases  [10]float64
+	PCA     *PCA `json:",omitempty"`
+
+	PCAComponents int     `json:",omitempty"`
+	L2            float64 `json:",omitempty"`
+	L1            float64 `json:",omitempty"`
+	Optimizer     string  `json:",omitempty"`
+	Iterations    int     `json:",omitempty"`
+}
+
+// DeserializeSoftmax deserializes a Softmax that was
+// serialized with Softmax.Serialize().
+func DeserializeSoftmax(d []byte) (*Softmax, error) {
+	var res Softmax
+	data, err := decompress(d)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Train fits the weights to the training data.
+func (s *Softmax) Train(data, validation []*TrainingSample) {
+	targets := make([][10]float64, len(data))
+	for i, x := range data {
+		targets[i][x.Label] = 1
+	}
+	s.trainTargets(data, targets)
+
+	log.Println("Running cross validation...")
+	var correct int
+	for _, x := range validation {
+		if s.Classify(x.Sample) == x.Label {
+			correct++
+		}
+	}
+	log.Printf("Got %d/%d", correct, len(validation))
+}
+
+// TrainSoft trains the model to match target
+// distributions, minimizing cross-entropy.
+func (s *Softmax) TrainSoft(data []*SoftSample, validation []*TrainingSample) {
+	s.trainTargets(hardSamples(data), softTargets(data))
+
+	log.Println("Running cross validation...")
+	confusion := Confusion(s, validation)
+	log.Printf("Got %d/%d", confusion.Correct(), confusion.Total())
+}
+
+// Classify returns the most probable class.
+func (s *Softmax) Classify(sample *Sample) int {
+	logits := s.Scores(sample)
+	return maxIndex(logits[:])
+}
+
+// Scores returns the logit of each class.
+func (s *Softmax) Scores(sample *Sample) [10]float64 {
+	return s.logits(s.features(sample))
+}
+
+// Probabilities returns the predicted distribution
+// over classes.
+func (s *Softmax) Probabilities(sample *Sample) [10]float64 {
+	logits := s.logits(s.features(sample))
+	return softmaxProbs(logits)
+}
+
+// RenderImages renders each class's weight template,
+// with positive weights dark and negative weights
+// light.
+// Templates of PCA models are projected back into
+// pixel space.
+func (s *Softmax) RenderImages() []image.Image {
+	var templates []linalg.Vector
+	var maxAbs float64
+	for _, w := range s.Weights {
+		template := w
+		if s.PCA != nil {
+			template = s.PCA.InverseTransform(w)
+			for i, m := range s.PCA.Mean {
+				template[i] -= m
+			}
+		}
+		templates = append(templates, template)
+		for _, x := range template {
+			maxAbs = math.Max(maxAbs, math.Abs(x))
+		}
+	}
+	var res []image.Image
+	for _, template := range templates {
+		res = append(res, vectorImage(template, -maxAbs, maxAbs))
+	}
+	return res
+}
+
+// SerializerType returns the unique ID used to
+// serialize Softmax models.
+func (s *Softmax) SerializerType() string {
+	return softmaxSerializerID
+}
+
+// Serialize serializes the model.
+func (s *Softmax) Serialize() ([]byte, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return compress(data), nil
+}
+
+// trainTargets fits the model to a target
+// distribution for each sample.
+func (s *Softmax) trainTargets(data []*TrainingSample, targets [][10]float64) {
+	s.PCA = nil
+	if s.PCAComponents != 0 {
+		log.Println("Computing principal components...")
+		s.PCA = FitPCA(trainingVectors(data), &PCAConfig{Components: s.PCAComponents})
+	}
+	features := make([]linalg.Vector, len(data))
+	for i, x := range data {
+		features[i] = s.features(x.Sample)
+	}
+
+	obj := &softmaxObjective{
+		Features: features,
+		Targets:  targets,
+		L2:       s.L2,
+		L1:       s.L1,
+	}
+	params := make(linalg.Vector, obj.ParamCount())
+	switch s.Optimizer {
+	case "", SoftmaxLBFGS:
+		params = minimizeLBFGS(obj, params, s.iterations(softmaxLBFGSIters))
+	case SoftmaxSGD:
+		params = minimizeSGD(obj, params, s.iterations(softmaxSGDEpochs))
+	default:
+		panic("unknown optimizer: " + s.Optimizer)
+	}
+	s.setParams(params, len(features[0]))
+}
+
+func (s *Softmax) iterations(def int) int {
+	if s.Iterations != 0 {
+		return s.Iterations
+	}
+	return def
+}
+
+func (s *Softmax) setParams(params linalg.Vector, dim int) {
+	for class := range s.Weights {
+		s.Weights[class] = append(linalg.Vector{}, params[class*dim:(class+1)*dim]...)
+		s.Biases[class] = params[10*dim+class]
+	}
+}
+
+func (s *Softmax) features(sample *Sample) linalg.Vector {
+	if s.PCA != nil {
+		return s.PCA.Transform(sample[:])
+	}
+	return sample[:]
+}
+
+func (s *Softmax) logits(features linalg.Vector) [10]float64 {
+	var res [10]float64
+	for class, w := range s.Weights {
+		res[class] = s.Biases[class] + w.Dot(features)
+	}
+	return res
+}
+
+func softmaxProbs(logits [10]float64) [10]float64 {
+	max := maxValue(logits[:])
+	var sum float64
+	var res [10]float64
+	for i, x := range logits {
+		res[i] = math.Exp(x - max)
+		sum += res[i]
+	}
+	for i := range res {
+		res[i] /= sum
+	}
+	return res
+}
+
+// softmaxObjective is the regularized mean
+// cross-entropy of a linear softmax model.
+// Parameters are stored as ten weight vectors
+// followed by ten biases.
+type softmaxObjective struct {
+	Features []linalg.Vector
+	Targets  [][10]float64
+	L2       float64
+	L1       float64
+}
+
+func (s *softmaxObjective) ParamCount() int {
+	return 10*len(s.Features[0]) + 10
+}
+
+// Eval computes the objective and its gradient over
+// every sample.
+func (s *softmaxObjective) Eval(params linalg.Vector) (float64, linalg.Vector) {
+	return s.evalIndices(params, nil)
+}
+
+// evalIndices computes the objective and gradient on
+// a subset of samples, or on all samples if indices
+// is nil.
+// The data is split into one contiguous chunk per
+// goroutine and the chunks are summed in order, so
+// results are deterministic.
+func (s *softmaxObjective) evalIndices(params linalg.Vector,
+	indices []int) (float64, linalg.Vector) {
+	count := len(s.Features)
+	if indices != nil {
+		count = len(indices)
+	}
+	dim := len(s.Features[0])
+	chunks := parallelism()
+	losses := make([]float64, chunks)
+	grads := make([]linalg.Vector, chunks)
+	parallelFor(chunks, func(chunk int) {
+		grad := make(linalg.Vector, len(params))
+		var loss float64
+		for i := chunk * count / chunks; i < (chunk+1)*count/chunks; i++ {
+			idx := i
+			if indices != nil {
+				idx = indices[i]
+			}
+			features := s.Features[idx]
+			var logits [10]float64
+			for class := range logits {
+				w := params[class*dim : (class+1)*dim]
+				logits[class] = params[10*dim+class] + w.Dot(features)
+			}
+			probs := softmaxProbs(logits)
+			for class, target := range s.Targets[idx] {
+				if target != 0 {
+					loss -= target * math.Log(math.Max(probs[class], 1e-300))
+				}
+				delta := probs[class] - target
+				gradW := grad[class*dim : (class+1)*dim]
+				for j, x := range features {
+					gradW[j] += delta * x
+				}
+				grad[10*dim+class] += delta
+			}
+		}
+		losses[chunk] = loss
+		grads[chunk] = grad
+	})
+
+	loss := 0.0
+	grad := make(linalg.Vector, len(params))
+	for chunk, chunkGrad := range grads {
+		loss += losses[chunk]
+		for i, x := range chunkGrad {
+			grad[i] += x
+		}
+	}
+	loss /= float64(count)
+	for i := range grad {
+		grad[i] /= float64(count)
+	}
+
+	for i, w := range params[:10*dim] {
+		if s.L2 != 0 {
+			loss += 0.5 * s.L2 * w * w
+			grad[i] += s.L2 * w
+		}
+		if s.L1 != 0 {
+			smoothAbs := math.Sqrt(w*w + softmaxL1Smoothing)
+			loss += s.L1 * smoothAbs
+			grad[i] += s.L1 * w / smoothAbs
+		}
+	}
+	return loss, grad
+}
+
+// minimizeLBFGS runs L-BFGS with a backtracking line
+// search.
+func minimizeLBFGS(obj *softmaxObjective, params linalg.Vector, iters int) linalg.Vector {
+	loss, grad := obj.Eval(params)
+	var sHist, yHist []linalg.Vector
+	var rhoHist []float64
+	for iter := 0; iter < iters; iter++ {
+		// At a stationary point, there is no direction
+		// to normalize.
+		if grad.Mag() < softmaxGradEpsilon {
+			log.Printf("Converged after %d iterations: loss=%f", iter, loss)
+			break
+		}
+
+		// Two-loop recursion to compute the search direction.
+		dir := append(linalg.Vector{}, grad...)
+		alphas := make([]float64, len(sHist))
+		for i := len(sHist) - 1; i >= 0; i-- {
+			alphas[i] = rhoHist[i] * sHist[i].Dot(dir)
+			for j, y := range yHist[i] {
+				dir[j] -= alphas[i] * y
+			}
+		}
+		if len(sHist) > 0 {
+			last := len(sHist) - 1
+			gamma := sHist[last].Dot(yHist[last]) / yHist[last].Dot(yHist[last])
+			for j := range dir {
+				dir[j] *= gamma
+			}
+		} else {
+			gradMag := grad.Mag()
+			for j := range dir {
+				dir[j] /= gradMag
+			}
+		}
+		for i := range sHist {
+			beta := rhoHist[i] * yHist[i].Dot(dir)
+			for j, s := range sHist[i] {
+				dir[j] += s * (alphas[i] - beta)
+			}
+		}
+		for j := range dir {
+			dir[j] = -dir[j]
+		}
+
+		slope := dir.Dot(grad)
+		if slope >= 0 {
+			// Not a descent direction; restart from steepest descent.
+			sHist, yHist, rhoHist = nil, nil, nil
+			continue
+		}
+		step := 1.0
+		var newParams, newGrad linalg.Vector
+		var newLoss float64
+		for {
+			newParams = make(linalg.Vector, len(params))
+			for j, p := range params {
+				newParams[j] = p + step*dir[j]
+			}
+			newLoss, newGrad = obj.Eval(newParams)
+			if newLoss <= loss+1e-4*step*slope || step < 1e-10 {
+				break
+			}
+			step /= 2
+		}
+
+		sVec := make(linalg.Vector, len(params))
+		yVec := make(linalg.Vector, len(params))
+		for j := range sVec {
+			sVec[j] = newParams[j] - params[j]
+			yVec[j] = newGrad[j] - grad[j]
+		}
+		if sy := sVec.Dot(yVec); sy > 1e-10 {
+			sHist = append(sHist, sVec)
+			yHist = append(yHist, yVec)
+			rhoHist = append(rhoHist, 1/sy)
+			if len(sHist) > softmaxLBFGSHistory {
+				sHist, yHist, rhoHist = sHist[1:], yHist[1:], rhoHist[1:]
+			}
+		}
+
+		converged := math.Abs(loss-newLoss) < 1e-9*math.Max(1, math.Abs(loss))
+		params, loss, grad = newParams, newLoss, newGrad
+		if (iter+1)%10 == 0 {
+			log.Printf("Iteration %d: loss=%f", iter+1, loss)
+		}
+		if converged {
+			log.Printf("Converged after %d iterations: loss=%f", iter+1, loss)
+			break
+		}
+	}
+	return params
+}
+
+// minimizeSGD runs minibatch SGD for the given
+// number of epochs.
+func minimizeSGD(obj *softmaxObjective, params linalg.Vector, epochs int) linalg.Vector {
+	for epoch := 0; epoch < epochs; epoch++ {
+		perm := rand.Perm(len(obj.Features))
+		var totalLoss float64
+		var batches int
+		for i := 0; i < len(perm); i += softmaxSGDBatch {
+			end := i + softmaxSGDBatch
+			if end > len(perm) {
+				end = len(perm)
+			}
+			loss, grad := obj.evalIndices(params, perm[i:end])
+			for j, g := range grad {
+				params[j] -= softmaxSGDStep * g
+			}
+			totalLoss += loss
+			batches++
+		}
+		log.Printf("Epoch %d: loss=%f", epoch+1, totalLoss/float64(batches))
+	}
+	return params
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/unixpickle/mnist"
+	"github.com/unixpickle/mnistdemo"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+)
+
+func main() {
+	var config mnistdemo.PCAConfig
+	var outFile string
+	flag.IntVar(&config.SampleCount, "samples", 0,
+		"samples for estimating covariance (0 for exact)")
+	flag.IntVar(&config.Components, "components", 50, "number of components")
+	flag.Float64Var(&config.TargetVariance, "variance", 0,
+		"fraction of variance to explain (overrides -components)")
+	flag.Float64Var(&config.Tolerance, "tol", 0, "eigenvalue convergence tolerance")
+	flag.StringVar(&outFile, "out", "", "optional file to save the fitted PCA")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags]\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Prints the PCA spectrum of the MNIST training set as CSV.")
+		fmt.Fprintln(os.Stderr)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var data []linalg.Vector
+	for _, sample := range mnist.LoadTrainingDataSet().Samples {
+		data = append(data, sample.Intensities)
+	}
+	pca := mnistdemo.FitPCA(data, &config)
+
+	fmt.Println("component,variance,explained,cumulative")
+	var cumulative float64
+	for i, ratio := range pca.ExplainedVariance() {
+		cumulative += ratio
+		fmt.Printf("%d,%f,%f,%f\n", i, pca.Variances[i], ratio, cumulative)
+	}
+
+	if outFile != "" {
+		resData, err := serializer.SerializeWithType(pca)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to serialize:", err)
+			os.Exit(1)
+		}
+		if err := ioutil.WriteFile(outFile, resData, 0755); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to save:", err)
+			os.Exit(1)
+		}
+	}
+}
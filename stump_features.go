@@ -0,0 +1,414 @@
+package mnistdemo
+
+import (
+	"math/rand"
+	"sort"
+)
+
+const (
+	stumpsPairCount       = 2000
+	stumpsLearnedCutoffs  = 10
+	stumpsThresholdSubset = 2000
+	stumpsPoolMemory      = 1 << 28
+	stumpsPoolChunkSize   = 1024
+)
+
+// Names of the weak learner families which Stumps
+// may draw from.
+const (
+	StumpFamilyPixel = "pixel"
+	StumpFamilyPair  = "pair"
+	StumpFamilyHaar  = "haar"
+
+	StumpFamilyFeature = "feature"
+)
+
+// A StumpFeature is a scalar feature of a Sample
+// which a stump compares against a threshold.
+//
+// A pixel feature (the zero Kind) is the intensity
+// at (X, Y).
+// A pair feature is the intensity at (X, Y) minus
+// the intensity at (X2, Y2).
+// A haar feature is a signed sum of rectangles.
+// A feature feature is element X of the vector from
+// a FeatureExtractor.
+type StumpFeature struct {
+	Kind  string `json:",omitempty"`
+	X     int
+	Y     int
+	X2    int         `json:",omitempty"`
+	Y2    int         `json:",omitempty"`
+	Rects []*HaarRect `json:",omitempty"`
+}
+
+// A HaarRect is one rectangle of a Haar-like
+// feature.
+type HaarRect struct {
+	X      int
+	Y      int
+	Width  int
+	Height int
+	Sign   float64
+}
+
+// Value computes the feature for an image.
+func (f *StumpFeature) Value(img *stumpImage) float64 {
+	switch f.Kind {
+	case StumpFamilyPair:
+		return img.Sample[f.X+f.Y*28] - img.Sample[f.X2+f.Y2*28]
+	case StumpFamilyHaar:
+		var sum float64
+		for _, r := range f.Rects {
+			sum += r.Sign * img.RectSum(r)
+		}
+		return sum
+	case StumpFamilyFeature:
+		return img.Inputs[f.X]
+	default:
+		return img.Sample[f.X+f.Y*28]
+	}
+}
+
+// stumpImage wraps a Sample and optionally caches
+// its integral image for Haar-like features.
+// Inputs holds the sample's extracted features, if
+// there is a FeatureExtractor.
+type stumpImage struct {
+	Sample   *Sample
+	Inputs   []float64
+	integral *[29 * 29]float64
+}
+
+// newStumpImage creates a stumpImage which computes
+// rectangle sums directly from the pixels.
+// This is cheapest when few features are evaluated.
+func newStumpImage(s *Sample, f *FeatureExtractor) *stumpImage {
+	res := &stumpImage{Sample: s}
+	if f != nil {
+		res.Inputs = f.Inputs(s)
+	}
+	return res
+}
+
+// newIntegralImage creates a stumpImage with a
+// precomputed integral image, making every rectangle
+// sum constant time.
+func newIntegralImage(s *Sample, f *FeatureExtractor) *stumpImage {
+	res := newStumpImage(s, f)
+	res.integral = new([29 * 29]float64)
+	for y := 0; y < 28; y++ {
+		var rowSum float64
+		for x := 0; x < 28; x++ {
+			rowSum += s[x+y*28]
+			res.integral[(x+1)+(y+1)*29] = res.integral[(x+1)+y*29] + rowSum
+		}
+	}
+	return res
+}
+
+// RectSum returns the sum of the pixels within a
+// rectangle.
+func (s *stumpImage) RectSum(r *HaarRect) float64 {
+	x1, y1 := r.X, r.Y
+	x2, y2 := r.X+r.Width, r.Y+r.Height
+	if s.integral == nil {
+		var sum float64
+		for y := y1; y < y2; y++ {
+			for x := x1; x < x2; x++ {
+				sum += s.Sample[x+y*28]
+			}
+		}
+		return sum
+	}
+	return s.integral[x2+y2*29] - s.integral[x1+y2*29] -
+		s.integral[x2+y1*29] + s.integral[x1+y1*29]
+}
+
+// withIntegral returns a copy of the image with a
+// precomputed integral image.
+func (s *stumpImage) withIntegral() *stumpImage {
+	res := newIntegralImage(s.Sample, nil)
+	res.Inputs = s.Inputs
+	return res
+}
+
+// stumpFamilyFeatures generates all the features in
+// a weak learner family.
+// The feature family requires a FeatureExtractor.
+func stumpFamilyFeatures(family string, extractor *FeatureExtractor) []*StumpFeature {
+	var res []*StumpFeature
+	switch family {
+	case StumpFamilyPixel:
+		for y := 0; y < 28; y++ {
+			for x := 0; x < 28; x++ {
+				res = append(res, &StumpFeature{X: x, Y: y})
+			}
+		}
+	case StumpFamilyPair:
+		gen := rand.New(rand.NewSource(stumpsPairCount))
+		for i := 0; i < stumpsPairCount; i++ {
+			p1, p2 := gen.Intn(28*28), gen.Intn(28*28)
+			if p1 == p2 {
+				i--
+				continue
+			}
+			res = append(res, &StumpFeature{
+				Kind: StumpFamilyPair,
+				X:    p1 % 28,
+				Y:    p1 / 28,
+				X2:   p2 % 28,
+				Y2:   p2 / 28,
+			})
+		}
+	case StumpFamilyHaar:
+		for h := 2; h <= 8; h += 2 {
+			for w := 2; w <= 8; w += 2 {
+				res = append(res, haarFeatures(w, h)...)
+			}
+		}
+	case StumpFamilyFeature:
+		if extractor == nil {
+			panic("stump family requires a feature extractor: " + family)
+		}
+		for i := 0; i < extractor.Dim(); i++ {
+			res = append(res, &StumpFeature{Kind: StumpFamilyFeature, X: i})
+		}
+	default:
+		panic("unknown stump family: " + family)
+	}
+	return res
+}
+
+// haarFeatures generates the two-rectangle and
+// three-rectangle features whose rectangles have
+// the given size.
+func haarFeatures(w, h int) []*StumpFeature {
+	var res []*StumpFeature
+	layouts := [][]*HaarRect{
+		{{Width: w, Height: h, Sign: 1}, {X: w, Width: w, Height: h, Sign: -1}},
+		{{Width: w, Height: h, Sign: 1}, {Y: h, Width: w, Height: h, Sign: -1}},
+		{{Width: w, Height: h, Sign: 1}, {X: w, Width: w, Height: h, Sign: -2},
+			{X: 2 * w, Width: w, Height: h, Sign: 1}},
+	}
+	for _, layout := range layouts {
+		var width, height int
+		for _, r := range layout {
+			width = maxInt(width, r.X+r.Width)
+			height = maxInt(height, r.Y+r.Height)
+		}
+		for y := 0; y+height <= 28; y += 2 {
+			for x := 0; x+width <= 28; x += 2 {
+				f := &StumpFeature{Kind: StumpFamilyHaar, X: x, Y: y}
+				for _, r := range layout {
+					rCopy := *r
+					rCopy.X += x
+					rCopy.Y += y
+					f.Rects = append(f.Rects, &rCopy)
+				}
+				res = append(res, f)
+			}
+		}
+	}
+	return res
+}
+
+// A stumpPool stores candidate features along with
+// their thresholds.
+//
+// To keep memory bounded, only as many feature
+// columns as fit in stumpsPoolMemory are cached as
+// bin indices; the rest are recomputed every time
+// they are needed.
+// Images stores every sample along with its extracted
+// features.
+type stumpPool struct {
+	Samples    []*TrainingSample
+	Images     []*stumpImage
+	Features   []*StumpFeature
+	Thresholds [][]float64
+
+	cache [][]uint8
+}
+
+// newStumpPool creates a pool for the families,
+// which default to the feature family if there is a
+// FeatureExtractor and to pixels otherwise.
+func newStumpPool(data []*TrainingSample, families []string, learned bool,
+	extractor *FeatureExtractor) *stumpPool {
+	if len(families) == 0 {
+		if extractor != nil {
+			families = []string{StumpFamilyFeature}
+		} else {
+			families = []string{StumpFamilyPixel}
+		}
+	}
+	res := &stumpPool{Samples: data, Images: make([]*stumpImage, len(data))}
+	parallelFor(len(data), func(i int) {
+		res.Images[i] = newStumpImage(data[i].Sample, extractor)
+	})
+	for _, family := range families {
+		res.Features = append(res.Features, stumpFamilyFeatures(family, extractor)...)
+	}
+	res.Thresholds = make([][]float64, len(res.Features))
+	res.cache = make([][]uint8, len(res.Features))
+
+	subset := res.Images
+	if len(subset) > stumpsThresholdSubset {
+		subset = make([]*stumpImage, stumpsThresholdSubset)
+		for i, j := range rand.Perm(len(data))[:len(subset)] {
+			subset[i] = res.Images[j]
+		}
+	}
+	subsetImages := integralImages(subset)
+	parallelFor(len(res.Features), func(i int) {
+		f := res.Features[i]
+		// Pixels and extracted features are all
+		// between 0 and 1.
+		if (f.Kind == "" || f.Kind == StumpFamilyFeature) && !learned {
+			res.Thresholds[i] = stumpsGridThresholds(0, 1)
+			return
+		}
+		values := make([]float64, len(subset))
+		for j, img := range subsetImages {
+			values[j] = f.Value(img)
+		}
+		sort.Float64s(values)
+		if learned {
+			res.Thresholds[i] = stumpsQuantileThresholds(values)
+		} else {
+			res.Thresholds[i] = stumpsGridThresholds(values[0], values[len(values)-1])
+		}
+	})
+
+	cacheCount := len(res.Features)
+	if len(data) > 0 {
+		cacheCount = minInt(cacheCount, stumpsPoolMemory/len(data))
+	}
+	for i := 0; i < cacheCount; i++ {
+		res.cache[i] = make([]uint8, len(data))
+	}
+	for start := 0; start < len(data); start += stumpsPoolChunkSize {
+		end := minInt(len(data), start+stumpsPoolChunkSize)
+		images := integralImages(res.Images[start:end])
+		parallelFor(cacheCount, func(i int) {
+			f := res.Features[i]
+			thresholds := res.Thresholds[i]
+			for j, img := range images {
+				res.cache[i][start+j] = stumpBin(thresholds, f.Value(img))
+			}
+		})
+	}
+	return res
+}
+
+// Bins returns, for every sample, the number of the
+// feature's thresholds which the sample exceeds.
+// If the feature is not cached, buf is used to store
+// the result.
+func (s *stumpPool) Bins(feature int, buf []uint8) []uint8 {
+	if s.cache[feature] != nil {
+		return s.cache[feature]
+	}
+	return s.computeBins(feature, buf)
+}
+
+func (s *stumpPool) computeBins(feature int, buf []uint8) []uint8 {
+	f := s.Features[feature]
+	thresholds := s.Thresholds[feature]
+	for i, img := range s.Images {
+		buf[i] = stumpBin(thresholds, f.Value(img))
+	}
+	return buf
+}
+
+// stumpBin counts the thresholds below a value.
+func stumpBin(thresholds []float64, value float64) uint8 {
+	return uint8(sort.SearchFloat64s(thresholds, value))
+}
+
+func integralImages(images []*stumpImage) []*stumpImage {
+	res := make([]*stumpImage, len(images))
+	parallelFor(len(images), func(i int) {
+		res[i] = images[i].withIntegral()
+	})
+	return res
+}
+
+// search evaluates every feature in parallel and
+// returns the result with the highest score.
+// Scratch buffers for uncached bins are recycled
+// between features.
+func (s *stumpPool) search(eval func(feature int, bins []uint8) stumpResult) stumpResult {
+	results := make([]stumpResult, len(s.Features))
+	buffers := make(chan []uint8, parallelism())
+	parallelFor(len(s.Features), func(i int) {
+		var buf []uint8
+		select {
+		case buf = <-buffers:
+		default:
+			buf = make([]uint8, len(s.Samples))
+		}
+		results[i] = eval(i, s.Bins(i, buf))
+		select {
+		case buffers <- buf:
+		default:
+		}
+	})
+	best := results[0]
+	for _, res := range results[1:] {
+		if res.Score > best.Score {
+			best = res
+		}
+	}
+	return best
+}
+
+type stumpResult struct {
+	Score     float64
+	Feature   int
+	Threshold float64
+	Greater   int
+	LessEqual int
+}
+
+func stumpsGridThresholds(min, max float64) []float64 {
+	res := make([]float64, stumpsCutoffCount)
+	for i := range res {
+		frac := float64(i+1) / float64(stumpsCutoffCount+1)
+		res[i] = min + (max-min)*frac
+	}
+	return res
+}
+
+func stumpsQuantileThresholds(sorted []float64) []float64 {
+	var res []float64
+	for i := 0; i < stumpsLearnedCutoffs; i++ {
+		frac := float64(i+1) / float64(stumpsLearnedCutoffs+1)
+		value := sorted[int(frac*float64(len(sorted)))]
+		if value == sorted[len(sorted)-1] {
+			break
+		}
+		if len(res) == 0 || value > res[len(res)-1] {
+			res = append(res, value)
+		}
+	}
+	if len(res) == 0 {
+		res = append(res, sorted[0])
+	}
+	return res
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
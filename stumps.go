@@ -2,6 +2,7 @@ package mnistdemo
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"math"
 	"strconv"
@@ -15,23 +16,30 @@ const (
 	stumpsStepCount    = 300
 	stumpsCutoffCount  = 5
 	stumpsSerializerID = "github.com/unixpickle/mnistdemo.Stumps"
+
+	binaryStumpsSerializerID = "github.com/unixpickle/mnistdemo.BinaryStumps"
 )
 
 func init() {
 	serializer.RegisterTypedDeserializer(stumpsSerializerID, DeserializeStumps)
+	serializer.RegisterTypedDeserializer(binaryStumpsSerializerID,
+		DeserializeBinaryStumps)
 }
 
+// A Stump is a weak learner for one-vs-rest
+// boosting.
+// It outputs Weight if its feature is greater than
+// Threshold and -Weight otherwise.
 type Stump struct {
 	Weight    float64
 	Threshold float64
-	X         int
-	Y         int
+	StumpFeature
 }
 
 func (s *Stump) Classify(b boosting.SampleList) linalg.Vector {
 	res := make(linalg.Vector, b.Len())
-	for i, sample := range b.(stumpSampleList) {
-		if s.ClassifySingle(sample.Sample) {
+	for i, img := range b.(stumpSampleList) {
+		if s.classifyImage(img) {
 			res[i] = s.Weight
 		} else {
 			res[i] = -s.Weight
@@ -40,12 +48,70 @@ func (s *Stump) Classify(b boosting.SampleList) linalg.Vector {
 	return res
 }
 
-func (s *Stump) ClassifySingle(sample *Sample) bool {
-	return sample[s.X+s.Y*28] > s.Threshold
+// ClassifySingle applies the stump to a sample.
+// f is the Features of the Stumps which the stump
+// belongs to.
+func (s *Stump) ClassifySingle(sample *Sample, f *FeatureExtractor) bool {
+	return s.classifyImage(newStumpImage(sample, f))
+}
+
+func (s *Stump) classifyImage(img *stumpImage) bool {
+	return s.Value(img) > s.Threshold
+}
+
+// A MultiStump is a weak learner for multiclass
+// boosting.
+// It votes for one class if its feature is above a
+// threshold and for another class otherwise.
+type MultiStump struct {
+	Weight    float64
+	Threshold float64
+	StumpFeature
+
+	Greater   int
+	LessEqual int
+}
+
+// Vote returns the class that the stump votes for.
+// f is the Features of the Stumps which the stump
+// belongs to.
+func (m *MultiStump) Vote(sample *Sample, f *FeatureExtractor) int {
+	return m.voteImage(newStumpImage(sample, f))
+}
+
+func (m *MultiStump) voteImage(img *stumpImage) int {
+	if m.Value(img) > m.Threshold {
+		return m.Greater
+	}
+	return m.LessEqual
 }
 
+// Stumps is a boosted ensemble of tree stumps.
+//
+// If Multiclass is false, Stumps stores a separate
+// one-vs-rest ensemble for each digit.
+// Otherwise, Rounds stores a single ensemble trained
+// jointly on all ten classes with SAMME.
+//
+// Families selects the weak learner families (see
+// StumpFamilyPixel, StumpFamilyPair and
+// StumpFamilyHaar) used during training, defaulting
+// to pixels alone.
+// If LearnedThresholds is set, thresholds are taken
+// from quantiles of the training data rather than
+// from a uniform grid.
+//
+// If Features is set, the StumpFamilyFeature family
+// thresholds its features, and Families defaults to
+// that family alone.
 type Stumps struct {
-	Stumps map[string][]*Stump
+	Multiclass bool
+	Stumps     [10][]*Stump
+	Rounds     []*MultiStump
+
+	Families          []string          `json:",omitempty"`
+	LearnedThresholds bool              `json:",omitempty"`
+	Features          *FeatureExtractor `json:",omitempty"`
 }
 
 func DeserializeStumps(d []byte) (*Stumps, error) {
@@ -55,16 +121,74 @@ func DeserializeStumps(d []byte) (*Stumps, error) {
 	}
 	var res Stumps
 	if err := json.Unmarshal(dec, &res); err != nil {
+		return deserializeLegacyStumps(dec)
+	}
+	return &res, nil
+}
+
+// deserializeLegacyStumps decodes models from before
+// Stumps was indexed by integer class labels.
+func deserializeLegacyStumps(dec []byte) (*Stumps, error) {
+	var legacy struct {
+		Stumps map[string][]*Stump
+	}
+	if err := json.Unmarshal(dec, &legacy); err != nil {
 		return nil, err
 	}
+	var res Stumps
+	for key, stumps := range legacy.Stumps {
+		digit, err := strconv.Atoi(key)
+		if err != nil || digit < 0 || digit >= 10 {
+			return nil, errors.New("invalid stump class: " + key)
+		}
+		res.Stumps[digit] = stumps
+	}
 	return &res, nil
 }
 
-func (s *Stumps) Train(data, validation []*TrainingSample) {
-	s.Stumps = map[string][]*Stump{}
+// Validate checks that every family is known, and
+// that the feature family has a FeatureExtractor.
+func (s *Stumps) Validate() error {
+	for _, family := range s.Families {
+		switch family {
+		case StumpFamilyPixel, StumpFamilyPair, StumpFamilyHaar:
+		case StumpFamilyFeature:
+			if s.Features == nil {
+				return errors.New("stump family requires a feature extractor: " + family)
+			}
+		default:
+			return errors.New("unknown stump family: " + family)
+		}
+	}
+	return nil
+}
 
+func (s *Stumps) Train(data, validation []*TrainingSample) {
+	if err := s.Validate(); err != nil {
+		panic(err)
+	}
 	log.Println("Creating stump pool...")
-	pool := createStumpPool(stumpSampleList(data))
+	pool := newStumpPool(data, s.Families, s.LearnedThresholds, s.Features)
+	log.Printf("Pool has %d features.", len(pool.Features))
+
+	if s.Multiclass {
+		s.trainMulticlass(data, pool)
+	} else {
+		s.trainOneVsRest(data, pool)
+	}
+
+	log.Println("Validating...")
+	var correct int
+	for _, sample := range validation {
+		if s.Classify(sample.Sample) == sample.Label {
+			correct++
+		}
+	}
+	log.Printf("Validation results: %d/%d", correct, len(validation))
+}
+
+func (s *Stumps) trainOneVsRest(data []*TrainingSample, pool *stumpPool) {
+	s.Stumps = [10][]*Stump{}
 	for digit := 0; digit < 10; digit++ {
 		log.Printf("Learning stumps for %d...", digit)
 		classVec := make(linalg.Vector, len(data))
@@ -75,53 +199,137 @@ func (s *Stumps) Train(data, validation []*TrainingSample) {
 				classVec[i] = -1
 			}
 		}
-		grad := boosting.Gradient{
-			Loss:    boosting.ExpLoss{},
-			Desired: classVec,
-			List:    stumpSampleList(data),
-			Pool:    pool,
-		}
-		for i := 0; i < stumpsStepCount; i++ {
-			grad.Step()
-		}
+		s.Stumps[digit] = boostStumps(pool, classVec, boosting.ExpLoss{}, stumpsStepCount)
+	}
+}
+
+// TrainSoft trains the stumps on target
+// distributions.
+//
+// One-vs-rest ensembles regress 2p-1 for each class's
+// target probability p with the squared loss.
+// SAMME only supports hard labels, so it is trained on
+// each sample's most likely class.
+func (s *Stumps) TrainSoft(data []*SoftSample, validation []*TrainingSample) {
+	hard := hardSamples(data)
+	log.Println("Creating stump pool...")
+	pool := newStumpPool(hard, s.Families, s.LearnedThresholds, s.Features)
+	log.Printf("Pool has %d features.", len(pool.Features))
 
-		var stumpList []*Stump
-		for i, stump := range grad.Sum.Classifiers {
-			sCopy := *stump.(*Stump)
-			sCopy.Weight = grad.Sum.Weights[i]
-			stumpList = append(stumpList, &sCopy)
+	if s.Multiclass {
+		s.trainMulticlass(hard, pool)
+	} else {
+		s.Stumps = [10][]*Stump{}
+		for digit := 0; digit < 10; digit++ {
+			log.Printf("Learning stumps for %d...", digit)
+			classVec := make(linalg.Vector, len(data))
+			for i, x := range data {
+				classVec[i] = 2*x.Probs[digit] - 1
+			}
+			s.Stumps[digit] = boostStumps(pool, classVec, boosting.SquareLoss{},
+				stumpsStepCount)
 		}
-		s.Stumps[strconv.Itoa(digit)] = stumpList
 	}
 
-	log.Println("Validating...")
-	var correct int
-	for _, sample := range validation {
-		if s.Classify(sample.Sample) == sample.Label {
-			correct++
+	log.Println("Running cross validation...")
+	confusion := Confusion(s, validation)
+	log.Printf("Got %d/%d", confusion.Correct(), confusion.Total())
+}
+
+// boostStumps runs gradient boosting to fit desired
+// outputs between -1 and 1 for the pool's samples.
+func boostStumps(pool *stumpPool, desired linalg.Vector, loss boosting.LossFunc,
+	steps int) []*Stump {
+	grad := boosting.Gradient{
+		Loss:    loss,
+		Desired: desired,
+		List:    stumpSampleList(pool.Images),
+		Pool:    pool,
+	}
+	for i := 0; i < steps; i++ {
+		grad.Step()
+	}
+
+	var stumpList []*Stump
+	for i, stump := range grad.Sum.Classifiers {
+		sCopy := *stump.(*Stump)
+		sCopy.Weight = grad.Sum.Weights[i]
+		stumpList = append(stumpList, &sCopy)
+	}
+	return stumpList
+}
+
+// stumpsMargin sums the outputs of boosted stumps.
+func stumpsMargin(stumps []*Stump, img *stumpImage) float64 {
+	var sum float64
+	for _, stump := range stumps {
+		if stump.classifyImage(img) {
+			sum += stump.Weight
+		} else {
+			sum -= stump.Weight
 		}
 	}
-	log.Printf("Validation results: %d/%d", correct, len(validation))
+	return sum
 }
 
-func (s *Stumps) Classify(sample *Sample) int {
-	bestSum := math.Inf(-1)
-	var bestDigit string
-	for digit, stumps := range s.Stumps {
-		var sum float64
-		for _, stump := range stumps {
-			if stump.ClassifySingle(sample) {
-				sum += stump.Weight
-			} else {
-				sum -= stump.Weight
+// trainMulticlass runs SAMME, the multiclass variant
+// of AdaBoost, so that every round picks the single
+// stump which best separates all ten classes under
+// the current sample weights.
+func (s *Stumps) trainMulticlass(data []*TrainingSample, pool *stumpPool) {
+	s.Rounds = nil
+
+	weights := make([]float64, len(data))
+	for i := range weights {
+		weights[i] = 1 / float64(len(data))
+	}
+
+	log.Println("Learning multiclass stumps...")
+	for round := 0; round < stumpsStepCount; round++ {
+		stump, errRate := pool.BestMultiStump(weights)
+		if errRate >= 1-1.0/10 {
+			log.Printf("Stopping early at round %d (error %f)", round, errRate)
+			break
+		}
+		errRate = math.Max(errRate, 1e-10)
+		stump.Weight = math.Log((1-errRate)/errRate) + math.Log(10-1)
+		s.Rounds = append(s.Rounds, stump)
+
+		var total float64
+		for i, x := range data {
+			if stump.voteImage(pool.Images[i]) != x.Label {
+				weights[i] *= math.Exp(stump.Weight)
 			}
+			total += weights[i]
 		}
-		if sum > bestSum {
-			bestSum = sum
-			bestDigit = digit
+		for i := range weights {
+			weights[i] /= total
+		}
+		if (round+1)%50 == 0 {
+			log.Printf("Round %d: weighted error %f", round+1, errRate)
 		}
 	}
-	res, _ := strconv.Atoi(bestDigit)
+}
+
+func (s *Stumps) Classify(sample *Sample) int {
+	scores := s.Scores(sample)
+	return maxIndex(scores[:])
+}
+
+// Scores computes the weighted votes for each class
+// (SAMME), or each one-vs-rest ensemble's output.
+func (s *Stumps) Scores(sample *Sample) [10]float64 {
+	img := newIntegralImage(sample, s.Features)
+	var res [10]float64
+	if s.Multiclass {
+		for _, stump := range s.Rounds {
+			res[stump.voteImage(img)] += stump.Weight
+		}
+		return res
+	}
+	for digit, stumps := range s.Stumps {
+		res[digit] = stumpsMargin(stumps, img)
+	}
 	return res
 }
 
@@ -137,27 +345,151 @@ func (s *Stumps) Serialize() ([]byte, error) {
 	return compress(data), nil
 }
 
-func createStumpPool(s boosting.SampleList) boosting.Pool {
-	var classifiers []boosting.Classifier
-	divide := 1 / float64(stumpsCutoffCount+1)
-	for y := 0; y < 28; y++ {
-		for x := 0; x < 28; x++ {
-			for cutoff := 0; cutoff < stumpsCutoffCount; cutoff++ {
-				thresh := divide * float64(cutoff+1)
-				classifiers = append(classifiers, &Stump{
-					Weight:    1,
-					Threshold: thresh,
-					X:         x,
-					Y:         y,
-				})
-			}
-		}
+// BinaryStumps is a boosted ensemble of tree stumps
+// for two-class problems, for use as a
+// BinaryClassifier.
+//
+// Families and LearnedThresholds work as they do for
+// Stumps.
+// Rounds defaults to the number of rounds used by
+// Stumps.
+type BinaryStumps struct {
+	Stumps []*Stump
+
+	Families          []string `json:",omitempty"`
+	LearnedThresholds bool     `json:",omitempty"`
+	Rounds            int      `json:",omitempty"`
+}
+
+// DeserializeBinaryStumps deserializes BinaryStumps
+// that were serialized with BinaryStumps.Serialize().
+func DeserializeBinaryStumps(d []byte) (*BinaryStumps, error) {
+	dec, err := decompress(d)
+	if err != nil {
+		return nil, err
+	}
+	var res BinaryStumps
+	if err := json.Unmarshal(dec, &res); err != nil {
+		return nil, err
 	}
-	return boosting.NewStaticPool(classifiers, s)
+	return &res, nil
+}
+
+// TrainBinary boosts stumps to fit the targets.
+func (b *BinaryStumps) TrainBinary(data []*TrainingSample, targets []float64) {
+	rounds := b.Rounds
+	if rounds == 0 {
+		rounds = stumpsStepCount
+	}
+	pool := newStumpPool(data, b.Families, b.LearnedThresholds, nil)
+	b.Stumps = boostStumps(pool, targets, boosting.ExpLoss{}, rounds)
+}
+
+// Margin returns the weighted sum of the stumps.
+func (b *BinaryStumps) Margin(s *Sample) float64 {
+	return stumpsMargin(b.Stumps, newIntegralImage(s, nil))
+}
+
+func (b *BinaryStumps) SerializerType() string {
+	return binaryStumpsSerializerID
 }
 
-type stumpSampleList []*TrainingSample
+func (b *BinaryStumps) Serialize() ([]byte, error) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	return compress(data), nil
+}
+
+type stumpSampleList []*stumpImage
 
 func (s stumpSampleList) Len() int {
 	return len(s)
 }
+
+// BestClassifier finds the one-vs-rest stump whose
+// output is most correlated with the loss gradient.
+// The boosting line search picks the sign and
+// magnitude of the stump's weight.
+func (s *stumpPool) BestClassifier(list boosting.SampleList,
+	grad linalg.Vector) boosting.Classifier {
+	best := s.search(func(feature int, bins []uint8) stumpResult {
+		thresholds := s.Thresholds[feature]
+		hist := make([]float64, len(thresholds)+1)
+		var total float64
+		for i, bin := range bins {
+			hist[bin] += grad[i]
+			total += grad[i]
+		}
+		res := stumpResult{Feature: feature, Score: math.Inf(-1)}
+		var greater float64
+		for cutoff := len(thresholds) - 1; cutoff >= 0; cutoff-- {
+			greater += hist[cutoff+1]
+			score := math.Abs(greater - (total - greater))
+			if score > res.Score {
+				res.Score = score
+				res.Threshold = thresholds[cutoff]
+			}
+		}
+		return res
+	})
+	return &Stump{
+		Weight:       1,
+		Threshold:    best.Threshold,
+		StumpFeature: *s.Features[best.Feature],
+	}
+}
+
+// BestMultiStump finds the multiclass stump with the
+// lowest weighted error, along with that error.
+func (s *stumpPool) BestMultiStump(weights []float64) (*MultiStump, float64) {
+	best := s.search(func(feature int, bins []uint8) stumpResult {
+		thresholds := s.Thresholds[feature]
+		hist := make([][10]float64, len(thresholds)+1)
+		var totals [10]float64
+		var totalWeight float64
+		for i, bin := range bins {
+			label := s.Samples[i].Label
+			hist[bin][label] += weights[i]
+			totals[label] += weights[i]
+			totalWeight += weights[i]
+		}
+
+		res := stumpResult{Feature: feature, Score: math.Inf(-1)}
+		var greater [10]float64
+		for cutoff := len(thresholds) - 1; cutoff >= 0; cutoff-- {
+			var lessEqual [10]float64
+			for class := range greater {
+				greater[class] += hist[cutoff+1][class]
+				lessEqual[class] = totals[class] - greater[class]
+			}
+			greaterClass := maxIndex(greater[:])
+			lessClass := maxIndex(lessEqual[:])
+			correct := (greater[greaterClass] + lessEqual[lessClass]) / totalWeight
+			if correct > res.Score {
+				res.Score = correct
+				res.Threshold = thresholds[cutoff]
+				res.Greater = greaterClass
+				res.LessEqual = lessClass
+			}
+		}
+		return res
+	})
+	return &MultiStump{
+		Threshold:    best.Threshold,
+		StumpFeature: *s.Features[best.Feature],
+		Greater:      best.Greater,
+		LessEqual:    best.LessEqual,
+	}, 1 - best.Score
+}
+
+func maxIndex(v []float64) int {
+	var bestIdx int
+	for i, x := range v {
+		if x > v[bestIdx] {
+			bestIdx = i
+		}
+	}
+	return bestIdx
+}
@@ -0,0 +1,640 @@
+package mnistdemo
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/gob"
+	"log"
+	"math"
+	"math/rand"
+
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+)
+
+const (
+	svmSerializerID       = "github.com/unixpickle/mnistdemo.SVM"
+	binarySVMSerializerID = "github.com/unixpickle/mnistdemo.BinarySVM"
+
+	svmDefaultC             = 5
+	svmDefaultSamples       = 10000
+	binarySVMDefaultSamples = 2000
+	svmDefaultDegree        = 3
+	svmTolerance            = 1e-3
+	svmTau                  = 1e-12
+	svmCacheMemory          = 1 << 28
+)
+
+// Kernels for SVM.
+const (
+	SVMLinear     = "linear"
+	SVMPolynomial = "poly"
+	SVMRBF        = "rbf"
+)
+
+func init() {
+	serializer.RegisterTypedDeserializer(svmSerializerID, DeserializeSVM)
+	serializer.RegisterTypedDeserializer(binarySVMSerializerID, DeserializeBinarySVM)
+}
+
+// An SVMKernel is a kernel function.
+//
+// The linear kernel is x*y, the polynomial kernel is
+// (Gamma*x*y + Coef0)^Degree, and the RBF kernel is
+// exp(-Gamma*|x-y|^2).
+type SVMKernel struct {
+	Kind   string
+	Gamma  float64
+	Coef0  float64
+	Degree int
+}
+
+// Eval computes the kernel from the dot product of
+// two vectors and their squared magnitudes.
+func (k *SVMKernel) Eval(dot, mag1, mag2 float64) float64 {
+	switch k.Kind {
+	case SVMLinear:
+		return dot
+	case SVMPolynomial:
+		return math.Pow(k.Gamma*dot+k.Coef0, float64(k.Degree))
+	case SVMRBF:
+		return math.Exp(-k.Gamma * math.Max(0, mag1+mag2-2*dot))
+	default:
+		panic("unknown kernel: " + k.Kind)
+	}
+}
+
+// An SVMMachine is a binary SVM which separates
+// class Positive from class Negative, or from every
+// other class if Negative is -1.
+//
+// Its decision function is the sum of
+// Coeffs[i]*K(Vectors[Indices[i]], x) minus Rho.
+type SVMMachine struct {
+	Positive int
+	Negative int
+	Indices  []int
+	Coeffs   []float64
+	Rho      float64
+}
+
+// SVM is a kernel support vector machine trained with
+// SMO.
+//
+// Support vectors are shared between the binary
+// machines and stored as bytes, like the images of
+// Neighbors.
+//
+// Kernel defaults to an RBF kernel whose Gamma is
+// picked from the variance of the data.
+// C defaults to 5.
+// Samples is the size of the training subset, which
+// defaults to 10000.
+// If OneVsRest is set, one machine is trained per
+// class; otherwise, one is trained per pair of
+// classes and they vote.
+//
+// If Features is set, the kernel compares its
+// features rather than pixels.
+type SVM struct {
+	Vectors  [][]byte
+	Machines []*SVMMachine
+
+	Kernel    *SVMKernel
+	C         float64
+	Samples   int
+	OneVsRest bool
+	Features  *FeatureExtractor
+}
+
+// DeserializeSVM deserializes an SVM that was
+// serialized with SVM.Serialize().
+func DeserializeSVM(d []byte) (*SVM, error) {
+	dec, err := decompress(d)
+	if err != nil {
+		return nil, err
+	}
+	gobReader := gob.NewDecoder(bytes.NewBuffer(dec))
+	var res SVM
+	if err := gobReader.Decode(&res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Train trains the binary machines on a random subset
+// of the data.
+func (s *SVM) Train(data, validation []*TrainingSample) {
+	count := s.Samples
+	if count == 0 {
+		count = svmDefaultSamples
+	}
+	subset := svmSubset(data, count)
+	count = len(subset)
+	inputs := s.Features.inputVectors(subset)
+	s.Kernel = defaultSVMKernel(s.Kernel, inputs)
+	c := s.C
+	if c == 0 {
+		c = svmDefaultC
+	}
+	vectors, mags := svmVectors(inputs)
+
+	// Classes missing from the data get no machines.
+	var present [10]bool
+	for _, x := range subset {
+		present[x.Label] = true
+	}
+	var machines []*SVMMachine
+	for pos := 0; pos < 10; pos++ {
+		if !present[pos] {
+			continue
+		}
+		if s.OneVsRest {
+			machines = append(machines, &SVMMachine{Positive: pos, Negative: -1})
+			continue
+		}
+		for neg := pos + 1; neg < 10; neg++ {
+			if present[neg] {
+				machines = append(machines, &SVMMachine{Positive: pos, Negative: neg})
+			}
+		}
+	}
+	log.Printf("Training %d machines on %d samples...", len(machines), count)
+
+	var indices [][]int
+	for _, m := range machines {
+		var machineIndices []int
+		for i, x := range subset {
+			if x.Label == m.Positive || m.Negative == -1 || x.Label == m.Negative {
+				machineIndices = append(machineIndices, i)
+			}
+		}
+		indices = append(indices, machineIndices)
+	}
+	cacheRows := svmCacheMemory / (8 * count * parallelism())
+	parallelFor(len(machines), func(i int) {
+		m := machines[i]
+		solver := &svmSolver{
+			Kernel:  s.Kernel,
+			C:       c,
+			Vectors: make([][]float64, len(indices[i])),
+			Mags:    make([]float64, len(indices[i])),
+			Labels:  make([]float64, len(indices[i])),
+		}
+		for j, idx := range indices[i] {
+			solver.Vectors[j] = vectors[idx]
+			solver.Mags[j] = mags[idx]
+			if subset[idx].Label == m.Positive {
+				solver.Labels[j] = 1
+			} else {
+				solver.Labels[j] = -1
+			}
+		}
+		alphas, rho, iters := solver.Solve(cacheRows)
+		m.Rho = rho
+		for j, alpha := range alphas {
+			if alpha != 0 {
+				m.Indices = append(m.Indices, indices[i][j])
+				m.Coeffs = append(m.Coeffs, alpha*solver.Labels[j])
+			}
+		}
+		log.Printf("Machine %d vs %d: %d iterations, %d support vectors",
+			m.Positive, m.Negative, iters, len(m.Coeffs))
+	})
+	s.setMachines(inputs, machines)
+	log.Printf("Stored %d support vectors.", len(s.Vectors))
+
+	log.Println("Running cross validation...")
+	var correct int
+	for _, x := range validation {
+		if s.Classify(x.Sample) == x.Label {
+			correct++
+		}
+	}
+	log.Printf("Got %d/%d", correct, len(validation))
+}
+
+// Classify evaluates every machine and returns the
+// class with the most votes, or the largest decision
+// value for one-vs-rest machines.
+func (s *SVM) Classify(sample *Sample) int {
+	scores := s.Scores(sample)
+	return maxIndex(scores[:])
+}
+
+// Scores returns the votes for each class, or each
+// class's decision value for one-vs-rest machines.
+func (s *SVM) Scores(sample *Sample) [10]float64 {
+	inputs := s.Features.Inputs(sample)
+	kernels := make([]float64, len(s.Vectors))
+	for i, v := range s.Vectors {
+		kernels[i] = s.Kernel.Eval(templateDot(inputs, v))
+	}
+	var scores [10]float64
+	if s.OneVsRest {
+		for i := range scores {
+			scores[i] = math.Inf(-1)
+		}
+	}
+	for _, m := range s.Machines {
+		value := -m.Rho
+		for i, idx := range m.Indices {
+			value += m.Coeffs[i] * kernels[idx]
+		}
+		if m.Negative == -1 {
+			scores[m.Positive] = value
+		} else if value > 0 {
+			scores[m.Positive]++
+		} else {
+			scores[m.Negative]++
+		}
+	}
+	return scores
+}
+
+func (s *SVM) SerializerType() string {
+	return svmSerializerID
+}
+
+func (s *SVM) Serialize() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(s); err != nil {
+		return nil, err
+	}
+	return compress(buf.Bytes()), nil
+}
+
+// defaultSVMKernel fills in default kernel
+// parameters, starting with an RBF kernel if kernel
+// is nil.
+// The default Gamma is 1/(d*v), where d is the
+// dimensionality and v is the variance of all the
+// values in the input vectors.
+func defaultSVMKernel(kernel *SVMKernel, inputs []linalg.Vector) *SVMKernel {
+	if kernel == nil {
+		kernel = &SVMKernel{Kind: SVMRBF}
+	}
+	if kernel.Degree == 0 {
+		kernel.Degree = svmDefaultDegree
+	}
+	if kernel.Gamma == 0 {
+		var sum, sqSum float64
+		for _, v := range inputs {
+			for _, x := range v {
+				sum += x
+				sqSum += x * x
+			}
+		}
+		n := float64(len(inputs) * len(inputs[0]))
+		variance := sqSum/n - (sum/n)*(sum/n)
+		kernel.Gamma = 1 / (float64(len(inputs[0])) * variance)
+		log.Printf("Using gamma=%f", kernel.Gamma)
+	}
+	return kernel
+}
+
+// svmVectors quantizes input vectors to bytes, as
+// they will be stored, and returns the quantized
+// vectors along with their squared magnitudes.
+func svmVectors(inputs []linalg.Vector) (vectors [][]float64, mags []float64) {
+	vectors = make([][]float64, len(inputs))
+	mags = make([]float64, len(inputs))
+	for i, x := range inputs {
+		quantized := vectorBytes(x)
+		vectors[i] = make([]float64, len(quantized))
+		for j, b := range quantized {
+			vectors[i][j] = float64(b) / 255
+			mags[i] += vectors[i][j] * vectors[i][j]
+		}
+	}
+	return
+}
+
+// svmSubset selects a random subset of the data.
+func svmSubset(data []*TrainingSample, count int) []*TrainingSample {
+	if count > len(data) {
+		count = len(data)
+	}
+	subset := make([]*TrainingSample, count)
+	for i, j := range rand.Perm(len(data))[:count] {
+		subset[i] = data[j]
+	}
+	return subset
+}
+
+// setMachines stores the support vectors used by the
+// machines and renumbers their indices.
+func (s *SVM) setMachines(inputs []linalg.Vector, machines []*SVMMachine) {
+	s.Vectors = nil
+	mapping := map[int]int{}
+	for _, m := range machines {
+		for i, idx := range m.Indices {
+			newIdx, ok := mapping[idx]
+			if !ok {
+				newIdx = len(s.Vectors)
+				mapping[idx] = newIdx
+				s.Vectors = append(s.Vectors, vectorBytes(inputs[idx]))
+			}
+			m.Indices[i] = newIdx
+		}
+	}
+	s.Machines = machines
+}
+
+// A BinarySVM is a two-class kernel SVM, for use as
+// a BinaryClassifier.
+//
+// Kernel, C and Samples work as they do for SVM,
+// except that Samples defaults to 2000.
+type BinarySVM struct {
+	Vectors [][]byte
+	Coeffs  []float64
+	Rho     float64
+
+	Kernel  *SVMKernel
+	C       float64
+	Samples int
+}
+
+// DeserializeBinarySVM deserializes a BinarySVM that
+// was serialized with BinarySVM.Serialize().
+func DeserializeBinarySVM(d []byte) (*BinarySVM, error) {
+	dec, err := decompress(d)
+	if err != nil {
+		return nil, err
+	}
+	var res BinarySVM
+	if err := gob.NewDecoder(bytes.NewBuffer(dec)).Decode(&res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// TrainBinary trains the machine on a random subset
+// of the data.
+func (b *BinarySVM) TrainBinary(data []*TrainingSample, targets []float64) {
+	count := b.Samples
+	if count == 0 {
+		count = binarySVMDefaultSamples
+	}
+	perm := rand.Perm(len(data))
+	if count < len(perm) {
+		perm = perm[:count]
+	}
+	subset := make([]*TrainingSample, len(perm))
+	labels := make([]float64, len(perm))
+	for i, j := range perm {
+		subset[i] = data[j]
+		labels[i] = targets[j]
+	}
+	inputs := trainingVectors(subset)
+	b.Kernel = defaultSVMKernel(b.Kernel, inputs)
+	c := b.C
+	if c == 0 {
+		c = svmDefaultC
+	}
+	vectors, mags := svmVectors(inputs)
+	solver := &svmSolver{
+		Kernel:  b.Kernel,
+		C:       c,
+		Vectors: vectors,
+		Mags:    mags,
+		Labels:  labels,
+	}
+	alphas, rho, _ := solver.Solve(svmCacheMemory / (8 * len(subset)))
+	b.Vectors, b.Coeffs, b.Rho = nil, nil, rho
+	for i, alpha := range alphas {
+		if alpha != 0 {
+			b.Vectors = append(b.Vectors, sampleBytes(subset[i].Sample))
+			b.Coeffs = append(b.Coeffs, alpha*labels[i])
+		}
+	}
+}
+
+// Margin evaluates the decision function.
+func (b *BinarySVM) Margin(s *Sample) float64 {
+	res := -b.Rho
+	for i, v := range b.Vectors {
+		res += b.Coeffs[i] * b.Kernel.Eval(templateDot(s[:], v))
+	}
+	return res
+}
+
+func (b *BinarySVM) SerializerType() string {
+	return binarySVMSerializerID
+}
+
+func (b *BinarySVM) Serialize() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(b); err != nil {
+		return nil, err
+	}
+	return compress(buf.Bytes()), nil
+}
+
+// svmSolver solves the dual problem of a binary SVM
+// using SMO with maximal violating pairs, as in
+// LIBSVM.
+type svmSolver struct {
+	Kernel  *SVMKernel
+	C       float64
+	Vectors [][]float64
+	Mags    []float64
+	Labels  []float64
+
+	cache *svmKernelCache
+}
+
+// Solve returns the dual coefficients, the bias term,
+// and the number of iterations performed.
+func (s *svmSolver) Solve(cacheRows int) (alphas []float64, rho float64, iters int) {
+	n := len(s.Vectors)
+	s.cache = newSVMKernelCache(cacheRows, s.kernelRow)
+	alphas = make([]float64, n)
+	grad := make([]float64, n)
+	diag := make([]float64, n)
+	for i := range grad {
+		grad[i] = -1
+		diag[i] = s.Kernel.Eval(s.Mags[i], s.Mags[i], s.Mags[i])
+	}
+
+	maxIters := maxInt(10000000, 100*n)
+	for iters = 0; iters < maxIters; iters++ {
+		i, j, gap := s.selectPair(alphas, grad)
+		if gap < svmTolerance {
+			break
+		}
+		rowI, rowJ := s.cache.Row(i), s.cache.Row(j)
+		oldI, oldJ := alphas[i], alphas[j]
+		yi, yj := s.Labels[i], s.Labels[j]
+		qij := yi * yj * rowI[j]
+		if yi != yj {
+			quad := math.Max(diag[i]+diag[j]+2*qij, svmTau)
+			delta := (-grad[i] - grad[j]) / quad
+			diff := alphas[i] - alphas[j]
+			alphas[i] += delta
+			alphas[j] += delta
+			if diff > 0 {
+				if alphas[j] < 0 {
+					alphas[j] = 0
+					alphas[i] = diff
+				}
+			} else if alphas[i] < 0 {
+				alphas[i] = 0
+				alphas[j] = -diff
+			}
+			if diff > 0 {
+				if alphas[i] > s.C {
+					alphas[i] = s.C
+					alphas[j] = s.C - diff
+				}
+			} else if alphas[j] > s.C {
+				alphas[j] = s.C
+				alphas[i] = s.C + diff
+			}
+		} else {
+			quad := math.Max(diag[i]+diag[j]-2*qij, svmTau)
+			delta := (grad[i] - grad[j]) / quad
+			sum := alphas[i] + alphas[j]
+			alphas[i] -= delta
+			alphas[j] += delta
+			if sum > s.C {
+				if alphas[i] > s.C {
+					alphas[i] = s.C
+					alphas[j] = sum - s.C
+				}
+			} else if alphas[j] < 0 {
+				alphas[j] = 0
+				alphas[i] = sum
+			}
+			if sum > s.C {
+				if alphas[j] > s.C {
+					alphas[j] = s.C
+					alphas[i] = sum - s.C
+				}
+			} else if alphas[i] < 0 {
+				alphas[i] = 0
+				alphas[j] = sum
+			}
+		}
+
+		deltaI, deltaJ := alphas[i]-oldI, alphas[j]-oldJ
+		for t := range grad {
+			grad[t] += s.Labels[t] * (yi*rowI[t]*deltaI + yj*rowJ[t]*deltaJ)
+		}
+	}
+	return alphas, s.computeRho(alphas, grad), iters
+}
+
+// selectPair finds the maximal violating pair and the
+// size of its KKT violation.
+func (s *svmSolver) selectPair(alphas, grad []float64) (i, j int, gap float64) {
+	maxUp, minLow := math.Inf(-1), math.Inf(1)
+	i, j = -1, -1
+	for t, y := range s.Labels {
+		value := -y * grad[t]
+		if s.isUp(t, alphas) && value > maxUp {
+			maxUp = value
+			i = t
+		}
+		if s.isLow(t, alphas) && value < minLow {
+			minLow = value
+			j = t
+		}
+	}
+	if i == -1 || j == -1 {
+		return 0, 0, 0
+	}
+	return i, j, maxUp - minLow
+}
+
+func (s *svmSolver) isUp(t int, alphas []float64) bool {
+	if s.Labels[t] > 0 {
+		return alphas[t] < s.C
+	}
+	return alphas[t] > 0
+}
+
+func (s *svmSolver) isLow(t int, alphas []float64) bool {
+	if s.Labels[t] > 0 {
+		return alphas[t] > 0
+	}
+	return alphas[t] < s.C
+}
+
+// computeRho computes the bias from the free support
+// vectors, or from the bounds on it if there are
+// none.
+func (s *svmSolver) computeRho(alphas, grad []float64) float64 {
+	var freeSum float64
+	var freeCount int
+	upper, lower := math.Inf(1), math.Inf(-1)
+	for t, y := range s.Labels {
+		value := y * grad[t]
+		if alphas[t] > 0 && alphas[t] < s.C {
+			freeSum += value
+			freeCount++
+		} else if (alphas[t] == s.C) == (y > 0) {
+			lower = math.Max(lower, value)
+		} else {
+			upper = math.Min(upper, value)
+		}
+	}
+	if freeCount > 0 {
+		return freeSum / float64(freeCount)
+	}
+	return (upper + lower) / 2
+}
+
+func (s *svmSolver) kernelRow(i int) []float64 {
+	row := make([]float64, len(s.Vectors))
+	v := s.Vectors[i]
+	for j, other := range s.Vectors {
+		var dot float64
+		for k, x := range v {
+			dot += x * other[k]
+		}
+		row[j] = s.Kernel.Eval(dot, s.Mags[i], s.Mags[j])
+	}
+	return row
+}
+
+// svmKernelCache stores recently used kernel rows,
+// evicting the least recently used row when full.
+type svmKernelCache struct {
+	maxRows int
+	compute func(i int) []float64
+	rows    map[int]*list.Element
+	lru     *list.List
+}
+
+type svmCacheEntry struct {
+	Index int
+	Row   []float64
+}
+
+func newSVMKernelCache(maxRows int, compute func(i int) []float64) *svmKernelCache {
+	return &svmKernelCache{
+		maxRows: maxInt(maxRows, 2),
+		compute: compute,
+		rows:    map[int]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// Row returns a row of the kernel matrix.
+func (s *svmKernelCache) Row(i int) []float64 {
+	if elem, ok := s.rows[i]; ok {
+		s.lru.MoveToFront(elem)
+		return elem.Value.(*svmCacheEntry).Row
+	}
+	if s.lru.Len() >= s.maxRows {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.rows, oldest.Value.(*svmCacheEntry).Index)
+	}
+	row := s.compute(i)
+	s.rows[i] = s.lru.PushFront(&svmCacheEntry{Index: i, Row: row})
+	return row
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/unixpickle/mnist"
 	"github.com/unixpickle/mnistdemo"
@@ -12,28 +16,348 @@ import (
 )
 
 func main() {
-	if len(os.Args) != 3 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <classifier> <output_file>\n", os.Args[0])
+	var stumpFamilies string
+	var stumpLearned bool
+	var rbfCenters, rbfLeastSquares int
+	var rbfInit string
+	var softmaxPCA, softmaxIters int
+	var softmaxL1 float64
+	var softmaxOptimizer string
+	var svmKernel mnistdemo.SVMKernel
+	var svmC float64
+	var svmSamples int
+	var svmOneVsRest bool
+	var gmmComponents, gmmFeatures int
+	var lvqRule string
+	var lvqPrototypes int
+	var ecocBase, ecocCode, ecocDecoding string
+	var ecocColumns int
+	var hierarchyFirst, hierarchySpecialist string
+	var hierarchyMaxGroup int
+	var cascadeStages string
+	var cascadeTarget float64
+	var augmentCopies int
+	var pipelineStages, pipelineInner string
+	var deskew bool
+	var features string
+	var hogCell, hogBlock, hogBins int
+	var netLayer, featureNet string
+	trainConfig := mnistdemo.DefaultTrainConfig()
+	flag.StringVar(&stumpFamilies, "stump-families", "",
+		"comma-separated weak learner families for stumps (pixel, pair, haar, feature)")
+	flag.BoolVar(&stumpLearned, "stump-learned", false,
+		"pick stump thresholds from the data distribution")
+	flag.IntVar(&rbfCenters, "rbf-centers", 0, "number of RBF centers (default 300)")
+	flag.StringVar(&rbfInit, "rbf-init", "",
+		"RBF center initialization (samples, kmeans, class-kmeans)")
+	flag.IntVar(&rbfLeastSquares, "rbf-lsq", 0,
+		"samples for RBF least-squares pre-training (default 10000)")
+	flag.IntVar(&softmaxPCA, "softmax-pca", -1,
+		"principal components for softmax (0 for raw pixels, -1 for the classifier default)")
+	flag.Float64Var(&softmaxL1, "softmax-l1", 0, "L1 regularization for softmax")
+	flag.StringVar(&softmaxOptimizer, "softmax-optimizer", "",
+		"optimizer for softmax (lbfgs, sgd)")
+	flag.IntVar(&softmaxIters, "softmax-iters", 0,
+		"L-BFGS iterations or SGD epochs for softmax")
+	flag.StringVar(&svmKernel.Kind, "svm-kernel", mnistdemo.SVMRBF,
+		"SVM kernel (linear, poly, rbf)")
+	flag.Float64Var(&svmKernel.Gamma, "svm-gamma", 0,
+		"SVM kernel gamma (default chosen from the data variance)")
+	flag.Float64Var(&svmKernel.Coef0, "svm-coef0", 1, "polynomial kernel offset")
+	flag.IntVar(&svmKernel.Degree, "svm-degree", 3, "polynomial kernel degree")
+	flag.Float64Var(&svmC, "svm-c", 0, "SVM regularization parameter (default 5)")
+	flag.IntVar(&svmSamples, "svm-samples", 0, "SVM training subset size (default 10000)")
+	flag.BoolVar(&svmOneVsRest, "svm-ovr", false, "train one-vs-rest SVMs instead of one-vs-one")
+	flag.IntVar(&gmmComponents, "gmm-components", 0, "gaussians per class (default 5)")
+	flag.IntVar(&gmmFeatures, "gmm-features", 0,
+		"principal components for gaussian mixtures (default 40)")
+	flag.StringVar(&lvqRule, "lvq-rule", "", "LVQ training rule (lvq1, lvq2.1, glvq)")
+	flag.IntVar(&lvqPrototypes, "lvq-prototypes", 0, "LVQ prototypes per class (default 10)")
+	flag.StringVar(&ecocBase, "ecoc-base", "", "binary classifier for ECOC (stumps, svm)")
+	flag.StringVar(&ecocCode, "ecoc-code", "",
+		"ECOC code matrix (ovr, ovo, random, exhaustive)")
+	flag.StringVar(&ecocDecoding, "ecoc-decoding", "", "ECOC decoding (loss, hamming)")
+	flag.IntVar(&ecocColumns, "ecoc-columns", 0, "columns in a random ECOC code (default 30)")
+	flag.StringVar(&hierarchyFirst, "first", "",
+		"first stage classifier for hierarchy (default softmax)")
+	flag.StringVar(&hierarchySpecialist, "specialist", "",
+		"specialist classifier for hierarchy (default svm)")
+	flag.IntVar(&hierarchyMaxGroup, "max-group", 0,
+		"largest group of confusable digits for hierarchy (default 3)")
+	flag.StringVar(&cascadeStages, "stages", "",
+		"comma-separated cascade stages, cheapest first (default stumps,neighbors)")
+	flag.Float64Var(&cascadeTarget, "target-accuracy", 0,
+		"validation accuracy for the cascade to reach (default that of the last stage)")
+	flag.StringVar(&pipelineStages, "transforms", "",
+		"comma-separated transformers for pipeline ("+transformerNames()+")")
+	flag.BoolVar(&deskew, "deskew", false,
+		"deskew samples before training and classification")
+	flag.StringVar(&pipelineInner, "inner", "",
+		"classifier inside a pipeline (default softmax) or netfeatures (default neighbors)")
+	flag.StringVar(&netLayer, "net-layer", "",
+		"network layer for netfeatures (pool, hidden; default hidden)")
+	flag.StringVar(&featureNet, "feature-net", "",
+		"trained neuralnet file for netfeatures (default trains a new network)")
+	flag.StringVar(&features, "features", "",
+		"comma-separated features for forest, stumps, neighbors, bayes and svm (hog, zoning, projection)")
+	flag.IntVar(&hogCell, "hog-cell", 0, "HOG cell size in pixels (default 7)")
+	flag.IntVar(&hogBlock, "hog-block", 0, "HOG block size in cells (default 2)")
+	flag.IntVar(&hogBins, "hog-bins", 0, "HOG orientation bins (default 9)")
+	flag.StringVar(&trainConfig.Augmentation, "augment", "",
+		"comma-separated augmenters ("+augmenterNames()+")")
+	flag.IntVar(&augmentCopies, "augment-copies", 1,
+		"augmented copies of each sample for learners without on-the-fly augmentation")
+	flag.StringVar(&trainConfig.Optimizer, "optimizer", trainConfig.Optimizer,
+		"optimizer for networks (sgd, momentum, nesterov, rmsprop, adam)")
+	flag.Float64Var(&trainConfig.StepSize, "step", trainConfig.StepSize, "SGD step size")
+	flag.IntVar(&trainConfig.BatchSize, "batch", trainConfig.BatchSize, "SGD batch size")
+	flag.Float64Var(trainConfig.Momentum, "momentum", *trainConfig.Momentum,
+		"momentum coefficient")
+	flag.Float64Var(trainConfig.Decay1, "decay1", *trainConfig.Decay1,
+		"first moment decay (Adam) or squared gradient decay (RMSProp)")
+	flag.Float64Var(trainConfig.Decay2, "decay2", *trainConfig.Decay2,
+		"second moment decay (Adam)")
+	flag.Float64Var(&trainConfig.WeightDecay, "weight-decay", 0,
+		"L2 weight decay (also the L2 penalty for softmax)")
+	flag.StringVar(&trainConfig.Schedule, "schedule", trainConfig.Schedule,
+		"step size schedule (constant, step, cosine, plateau)")
+	flag.IntVar(&trainConfig.Epochs, "epochs", 0, "training epochs (0 to train until ctrl+c)")
+	flag.IntVar(&trainConfig.WarmupEpochs, "warmup", 0, "epochs of linear warmup")
+	flag.IntVar(&trainConfig.DecayEvery, "decay-every", trainConfig.DecayEvery,
+		"epochs between decays for the step schedule")
+	flag.Float64Var(&trainConfig.DecayFactor, "decay-factor", trainConfig.DecayFactor,
+		"step size multiplier for the step and plateau schedules")
+	flag.IntVar(&trainConfig.Patience, "patience", trainConfig.Patience,
+		"epochs without improvement before a plateau decay")
+	flag.IntVar(&trainConfig.Workers, "workers", 0,
+		"goroutines per gradient computation (default GOMAXPROCS)")
+	flag.Int64Var(&trainConfig.Seed, "seed", 0,
+		"random seed for reproducible network training and augmentation")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <classifier> <output_file>\n", os.Args[0])
 		printClassifiers()
+		fmt.Fprintln(os.Stderr, "Flags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	desc, ok := mnistdemo.Classifiers[os.Args[1]]
+	desc, ok := mnistdemo.Classifiers[flag.Arg(0)]
 	if !ok {
-		fmt.Fprintln(os.Stderr, "Unknown classifier:", os.Args[1])
+		fmt.Fprintln(os.Stderr, "Unknown classifier:", flag.Arg(0))
 		os.Exit(1)
 	}
 
 	classifier := desc.Construct()
-	classifier.Train(mnistSamples(mnist.LoadTrainingDataSet()),
-		mnistSamples(mnist.LoadTestingDataSet()))
+
+	// Flags configure the classifier inside a pipeline
+	// rather than the pipeline itself.
+	model := classifier
+	if pipeline, ok := model.(*mnistdemo.Pipeline); ok {
+		if pipelineStages != "" {
+			if _, err := mnistdemo.ParseTransformers(pipelineStages); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			pipeline.Stages = nil
+			for _, name := range strings.Split(pipelineStages, ",") {
+				pipeline.Stages = append(pipeline.Stages, strings.TrimSpace(name))
+			}
+		}
+		pipeline.Inner = innerName(pipelineInner, "softmax")
+		pipeline.Model = mnistdemo.Classifiers[pipeline.Inner].Construct()
+		model = pipeline.Model
+	}
+	var netInner bool
+	if netFeatures, ok := model.(*mnistdemo.NetFeatures); ok {
+		netInner = true
+		if features != "" {
+			fmt.Fprintln(os.Stderr, "The features of netfeatures come from the network.")
+			os.Exit(1)
+		}
+		netFeatures.Layer = netLayer
+		netFeatures.Config = trainConfig
+		netFeatures.Inner = innerName(pipelineInner, "neighbors")
+		netFeatures.Model = mnistdemo.Classifiers[netFeatures.Inner].Construct()
+		if err := netFeatures.Validate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if featureNet != "" {
+			net, err := loadNeuralNet(featureNet)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Failed to load network:", err)
+				os.Exit(1)
+			}
+			netFeatures.Net = net
+		}
+		model = netFeatures.Model
+	}
+
+	if features != "" {
+		extractor, err := mnistdemo.ParseFeatureExtractor(features)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if extractor.HOG != nil {
+			if hogCell != 0 {
+				extractor.HOG.CellSize = hogCell
+			}
+			if hogBlock != 0 {
+				extractor.HOG.BlockSize = hogBlock
+			}
+			if hogBins != 0 {
+				extractor.HOG.Bins = hogBins
+			}
+		}
+		if err := extractor.Validate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		switch model := model.(type) {
+		case *mnistdemo.Forest:
+			model.Features = extractor
+		case *mnistdemo.Stumps:
+			model.Features = extractor
+		case *mnistdemo.Neighbors:
+			model.Features = extractor
+		case *mnistdemo.Bayes:
+			model.Features = extractor
+		case *mnistdemo.SVM:
+			model.Features = extractor
+		default:
+			fmt.Fprintln(os.Stderr, "Classifier does not support features:", flag.Arg(0))
+			os.Exit(1)
+		}
+	}
+
+	if stumps, ok := model.(*mnistdemo.Stumps); ok {
+		if stumpFamilies != "" {
+			stumps.Families = nil
+			for _, name := range strings.Split(stumpFamilies, ",") {
+				stumps.Families = append(stumps.Families, strings.TrimSpace(name))
+			}
+		}
+		stumps.LearnedThresholds = stumpLearned
+		check := *stumps
+		if netInner {
+			// netfeatures sets the features when it trains.
+			check.Features = &mnistdemo.FeatureExtractor{}
+		}
+		if err := check.Validate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if net, ok := model.(*mnistdemo.NeuralNet); ok {
+		net.Config = trainConfig
+	}
+	if rbfNet, ok := model.(*mnistdemo.RBFNet); ok {
+		rbfNet.Config = trainConfig
+		rbfNet.CenterCount = rbfCenters
+		rbfNet.CenterInit = rbfInit
+		rbfNet.LeastSquaresSamples = rbfLeastSquares
+	}
+	if softmax, ok := model.(*mnistdemo.Softmax); ok {
+		if softmaxPCA >= 0 {
+			softmax.PCAComponents = softmaxPCA
+		}
+		if trainConfig.WeightDecay != 0 {
+			softmax.L2 = trainConfig.WeightDecay
+		}
+		softmax.L1 = softmaxL1
+		softmax.Optimizer = softmaxOptimizer
+		softmax.Iterations = softmaxIters
+	}
+	if svm, ok := model.(*mnistdemo.SVM); ok {
+		svm.Kernel = &svmKernel
+		svm.C = svmC
+		svm.Samples = svmSamples
+		svm.OneVsRest = svmOneVsRest
+	}
+	if gmm, ok := model.(*mnistdemo.GMM); ok {
+		gmm.Components = gmmComponents
+		gmm.Features = gmmFeatures
+	}
+	if lvq, ok := model.(*mnistdemo.LVQ); ok {
+		lvq.Rule = lvqRule
+		lvq.PerClass = lvqPrototypes
+		lvq.Epochs = trainConfig.Epochs
+		if err := lvq.Validate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if ecoc, ok := model.(*mnistdemo.ECOC); ok {
+		ecoc.Base = ecocBase
+		ecoc.Code = ecocCode
+		ecoc.Decoding = ecocDecoding
+		ecoc.Columns = ecocColumns
+	}
+	if hierarchy, ok := model.(*mnistdemo.Hierarchy); ok {
+		hierarchy.First = innerName(hierarchyFirst, "softmax")
+		hierarchy.Specialist = innerName(hierarchySpecialist, "svm")
+		hierarchy.MaxGroup = hierarchyMaxGroup
+	}
+	if cascade, ok := model.(*mnistdemo.Cascade); ok {
+		if cascadeStages != "" {
+			cascade.Stages = nil
+			for _, name := range strings.Split(cascadeStages, ",") {
+				cascade.Stages = append(cascade.Stages, strings.TrimSpace(name))
+			}
+		}
+		if err := cascade.Validate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		cascade.TargetAccuracy = cascadeTarget
+	}
+
+	if deskew {
+		if pipeline, ok := classifier.(*mnistdemo.Pipeline); ok {
+			pipeline.Stages = append([]string{"deskew"}, pipeline.Stages...)
+		} else {
+			classifier = &mnistdemo.Pipeline{
+				Stages: []string{"deskew"},
+				Inner:  flag.Arg(0),
+				Model:  classifier,
+			}
+		}
+	}
+
+	training := mnistSamples(mnist.LoadTrainingDataSet())
+	if trainConfig.Augmentation != "" {
+		aug, err := mnistdemo.ParseAugmenter(trainConfig.Augmentation)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		switch model.(type) {
+		case *mnistdemo.NeuralNet, *mnistdemo.RBFNet:
+			// Minibatches are augmented during training.
+		default:
+			seed := trainConfig.Seed
+			if seed == 0 {
+				seed = time.Now().UnixNano()
+			}
+			gen := rand.New(rand.NewSource(seed))
+			training = mnistdemo.AugmentSamples(training, aug, augmentCopies, gen)
+		}
+	}
+
+	classifier.Train(training, mnistSamples(mnist.LoadTestingDataSet()))
 
 	resData, err := serializer.SerializeWithType(classifier)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Failed to serialize:", err)
 		os.Exit(1)
 	}
-	if err := ioutil.WriteFile(os.Args[2], resData, 0755); err != nil {
+	if err := ioutil.WriteFile(flag.Arg(1), resData, 0755); err != nil {
 		fmt.Fprintln(os.Stderr, "Failed to save:", err)
 		os.Exit(1)
 	}
@@ -53,6 +377,53 @@ func printClassifiers() {
 	fmt.Fprintln(os.Stderr)
 }
 
+func transformerNames() string {
+	var names []string
+	for name := range mnistdemo.Transformers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func augmenterNames() string {
+	var names []string
+	for name := range mnistdemo.Augmenters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// innerName returns the name of a nested classifier,
+// exiting if it is unknown.
+func innerName(name, defaultName string) string {
+	if name == "" {
+		name = defaultName
+	}
+	if _, ok := mnistdemo.Classifiers[name]; !ok {
+		fmt.Fprintln(os.Stderr, "Unknown classifier:", name)
+		os.Exit(1)
+	}
+	return name
+}
+
+func loadNeuralNet(path string) (*mnistdemo.NeuralNet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	model, err := serializer.DeserializeWithType(data)
+	if err != nil {
+		return nil, err
+	}
+	net, ok := model.(*mnistdemo.NeuralNet)
+	if !ok {
+		return nil, fmt.Errorf("model type %T is not a neural network", model)
+	}
+	return net, nil
+}
+
 func mnistSamples(d mnist.DataSet) []*mnistdemo.TrainingSample {
 	var res []*mnistdemo.TrainingSample
 	for _, sample := range d.Samples {
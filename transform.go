@@ -0,0 +1,239 @@
+package mnistdemo
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/serializer"
+)
+
+const (
+	blurSerializerID           = "github.com/unixpickle/mnistdemo.Blur"
+	binarizeSerializerID       = "github.com/unixpickle/mnistdemo.Binarize"
+	pcaReconstructSerializerID = "github.com/unixpickle/mnistdemo.PCAReconstruct"
+)
+
+func init() {
+	serializer.RegisterTypedDeserializer(blurSerializerID, DeserializeBlur)
+	serializer.RegisterTypedDeserializer(binarizeSerializerID, DeserializeBinarize)
+	serializer.RegisterTypedDeserializer(pcaReconstructSerializerID,
+		DeserializePCAReconstruct)
+}
+
+// A TransformerDesc includes a plain-text description
+// of a transformer as well as a constructor for it
+// with its default settings.
+type TransformerDesc struct {
+	Desc      string
+	Construct func() Transformer
+}
+
+// Transformers stores TransformerDescs for each
+// available transformer.
+var Transformers = map[string]TransformerDesc{
+	"deskew": TransformerDesc{
+		Desc: "straighten slanted digits",
+		Construct: func() Transformer {
+			return &Deskewer{}
+		},
+	},
+	"blur": TransformerDesc{
+		Desc: "gaussian blur",
+		Construct: func() Transformer {
+			return &Blur{Sigma: 0.7}
+		},
+	},
+	"binarize": TransformerDesc{
+		Desc: "threshold pixels to black or white",
+		Construct: func() Transformer {
+			return &Binarize{Threshold: 0.5}
+		},
+	},
+	"pca": TransformerDesc{
+		Desc: "project onto the principal components and back",
+		Construct: func() Transformer {
+			return &PCAReconstruct{Components: 50}
+		},
+	},
+}
+
+// ParseTransformers creates transformers from a
+// comma-separated list of names in Transformers.
+func ParseTransformers(spec string) ([]Transformer, error) {
+	var res []Transformer
+	for _, name := range strings.Split(spec, ",") {
+		desc, ok := Transformers[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown transformer: %s", name)
+		}
+		res = append(res, desc.Construct())
+	}
+	return res, nil
+}
+
+// transformSamples applies a transformer to every
+// sample, keeping the labels.
+func transformSamples(t Transformer, data []*TrainingSample) []*TrainingSample {
+	res := make([]*TrainingSample, len(data))
+	parallelFor(len(data), func(i int) {
+		res[i] = &TrainingSample{
+			Sample: t.Transform(data[i].Sample),
+			Label:  data[i].Label,
+		}
+	})
+	return res
+}
+
+// deserializeTransformer deserializes a Transformer
+// that was serialized with its type.
+func deserializeTransformer(data []byte) (Transformer, error) {
+	obj, err := serializer.DeserializeWithType(data)
+	if err != nil {
+		return nil, err
+	}
+	res, ok := obj.(Transformer)
+	if !ok {
+		return nil, fmt.Errorf("not a transformer: %T", obj)
+	}
+	return res, nil
+}
+
+// Blur smooths samples with a Gaussian of standard
+// deviation Sigma.
+type Blur struct {
+	Sigma float64
+}
+
+// DeserializeBlur deserializes a Blur that was
+// serialized with Blur.Serialize().
+func DeserializeBlur(d []byte) (*Blur, error) {
+	data, err := decompress(d)
+	if err != nil {
+		return nil, err
+	}
+	var res Blur
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Fit does nothing, since Blur has no learned
+// parameters.
+func (b *Blur) Fit(data []*TrainingSample) {
+}
+
+func (b *Blur) Transform(s *Sample) *Sample {
+	res := *s
+	gaussianBlur(res[:], b.Sigma)
+	return &res
+}
+
+func (b *Blur) SerializerType() string {
+	return blurSerializerID
+}
+
+func (b *Blur) Serialize() ([]byte, error) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	return compress(data), nil
+}
+
+// Binarize sets pixels above Threshold to 1 and all
+// others to 0.
+type Binarize struct {
+	Threshold float64
+}
+
+// DeserializeBinarize deserializes a Binarize that
+// was serialized with Binarize.Serialize().
+func DeserializeBinarize(d []byte) (*Binarize, error) {
+	data, err := decompress(d)
+	if err != nil {
+		return nil, err
+	}
+	var res Binarize
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Fit does nothing, since Binarize has no learned
+// parameters.
+func (b *Binarize) Fit(data []*TrainingSample) {
+}
+
+func (b *Binarize) Transform(s *Sample) *Sample {
+	res := new(Sample)
+	for i, x := range s {
+		if x > b.Threshold {
+			res[i] = 1
+		}
+	}
+	return res
+}
+
+func (b *Binarize) SerializerType() string {
+	return binarizeSerializerID
+}
+
+func (b *Binarize) Serialize() ([]byte, error) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	return compress(data), nil
+}
+
+// PCAReconstruct projects samples onto their first
+// Components principal components and back, which
+// removes noise that is unlike the training data.
+type PCAReconstruct struct {
+	Components int
+	PCA        *PCA
+}
+
+// DeserializePCAReconstruct deserializes a
+// PCAReconstruct that was serialized with
+// PCAReconstruct.Serialize().
+func DeserializePCAReconstruct(d []byte) (*PCAReconstruct, error) {
+	data, err := decompress(d)
+	if err != nil {
+		return nil, err
+	}
+	var res PCAReconstruct
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Fit computes the principal components.
+func (p *PCAReconstruct) Fit(data []*TrainingSample) {
+	p.PCA = FitPCA(trainingVectors(data), &PCAConfig{Components: p.Components})
+}
+
+func (p *PCAReconstruct) Transform(s *Sample) *Sample {
+	reconstructed := p.PCA.InverseTransform(p.PCA.Transform(linalg.Vector(s[:])))
+	res := new(Sample)
+	copy(res[:], reconstructed)
+	res.clip()
+	return res
+}
+
+func (p *PCAReconstruct) SerializerType() string {
+	return pcaReconstructSerializerID
+}
+
+func (p *PCAReconstruct) Serialize() ([]byte, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return compress(data), nil
+}